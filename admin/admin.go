@@ -0,0 +1,205 @@
+// Package admin serves blockspiderd's liveness, readiness, status, reorg
+// journal and metrics endpoints.
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/crawler"
+	"github.com/iquidus/blockspider/metrics"
+	"github.com/iquidus/blockspider/outbox"
+)
+
+const (
+	DefaultMaxLag       = 10   // blocks
+	DefaultStallTimeout = "5m" // without crawler progress
+
+	rpcTimeout = 5 * time.Second // for node calls made by handlers
+
+	defaultReorgsLimit = 100 // reorgs returned by /reorgs without a limit
+)
+
+type Config struct {
+	Addr         string `json:"addr"`         // listen address, disabled if empty
+	MaxLag       uint64 `json:"maxLag"`       // max blocks behind the node to be ready
+	StallTimeout string `json:"stallTimeout"` // max time without crawler progress to be live
+}
+
+// Crawler is implemented by crawler.Crawler
+type Crawler interface {
+	Status() crawler.Status
+	Reorgs(limit int) ([]common.Reorg, error)
+}
+
+// Node is implemented by common.RPCClient
+type Node interface {
+	LatestBlockNumber(ctx context.Context) (uint64, error)
+	Ping(ctx context.Context) (string, error)
+	Nodes() []common.NodeHealth
+}
+
+// Sinks is implemented by outbox.Dispatcher
+type Sinks interface {
+	Health() outbox.Health
+}
+
+// Readiness is returned by /readyz
+type Readiness struct {
+	Ready  bool   `json:"ready"`
+	Head   uint64 `json:"head"`
+	Remote uint64 `json:"remote"`
+	Lag    uint64 `json:"lag"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Status is returned by /status
+type Status struct {
+	crawler.Status
+	Node  NodeStatus    `json:"node"`
+	Sinks outbox.Health `json:"sinks"`
+}
+
+type NodeStatus struct {
+	Version string              `json:"version"`
+	Error   string              `json:"error,omitempty"`
+	Nodes   []common.NodeHealth `json:"nodes"` // pooled rpc nodes
+}
+
+type Server struct {
+	cfg          *Config
+	stallTimeout time.Duration
+	crawler      Crawler
+	node         Node
+	sinks        Sinks
+	http         *http.Server
+}
+
+func New(cfg *Config, crawler Crawler, node Node, sinks Sinks) (*Server, error) {
+	if cfg.MaxLag == 0 {
+		cfg.MaxLag = DefaultMaxLag
+	}
+	if cfg.StallTimeout == "" {
+		cfg.StallTimeout = DefaultStallTimeout
+	}
+	stallTimeout, err := time.ParseDuration(cfg.StallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:          cfg,
+		stallTimeout: stallTimeout,
+		crawler:      crawler,
+		node:         node,
+		sinks:        sinks,
+	}
+	s.http = &http.Server{Addr: cfg.Addr, Handler: s.Router()}
+	return s, nil
+}
+
+// Router returns the admin routes
+func (s *Server) Router() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	r.GET("/healthz", s.healthz)
+	r.GET("/readyz", s.readyz)
+	r.GET("/status", s.status)
+	r.GET("/reorgs", s.reorgs)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	return r
+}
+
+// ListenAndServe serves until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	err := s.http.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// live while the crawler is making progress and hasn't halted
+func (s *Server) healthz(c *gin.Context) {
+	status := s.crawler.Status()
+	if status.Halted != "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "halted", "reason": status.Halted})
+		return
+	}
+	since := time.Since(status.LastProgress)
+	if since > s.stallTimeout {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "stalled", "since": since.String()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ready while the cached head is within MaxLag of the node's head
+func (s *Server) readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rpcTimeout)
+	defer cancel()
+
+	r := Readiness{Head: s.crawler.Status().Head.Number}
+	remote, err := s.node.LatestBlockNumber(ctx)
+	if err != nil {
+		r.Error = err.Error()
+		c.JSON(http.StatusServiceUnavailable, r)
+		return
+	}
+	r.Remote = remote
+	if remote > r.Head {
+		r.Lag = remote - r.Head
+	}
+	r.Ready = r.Lag <= s.cfg.MaxLag
+	if !r.Ready {
+		c.JSON(http.StatusServiceUnavailable, r)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+func (s *Server) status(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rpcTimeout)
+	defer cancel()
+
+	st := Status{
+		Status: s.crawler.Status(),
+		Sinks:  s.sinks.Health(),
+	}
+	version, err := s.node.Ping(ctx)
+	st.Node.Version = version
+	st.Node.Nodes = s.node.Nodes()
+	if err != nil {
+		st.Node.Error = err.Error()
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// the reorg journal, newest first
+func (s *Server) reorgs(c *gin.Context) {
+	limit := defaultReorgsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	reorgs, err := s.crawler.Reorgs(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reorgs)
+}
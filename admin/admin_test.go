@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/crawler"
+	"github.com/iquidus/blockspider/outbox"
+)
+
+type testCrawler struct {
+	status crawler.Status
+	reorgs []common.Reorg
+}
+
+func (c *testCrawler) Status() crawler.Status {
+	return c.status
+}
+
+func (c *testCrawler) Reorgs(limit int) ([]common.Reorg, error) {
+	if limit < len(c.reorgs) {
+		return c.reorgs[:limit], nil
+	}
+	return c.reorgs, nil
+}
+
+type testNode struct {
+	head uint64
+	err  error
+}
+
+func (n *testNode) LatestBlockNumber(ctx context.Context) (uint64, error) {
+	return n.head, n.err
+}
+
+func (n *testNode) Ping(ctx context.Context) (string, error) {
+	return "reorgd/v0.0.1", n.err
+}
+
+func (n *testNode) Nodes() []common.NodeHealth {
+	return []common.NodeHealth{{Index: 0, Type: "http", Healthy: n.err == nil, Head: n.head}}
+}
+
+type testSinks struct {
+	health outbox.Health
+}
+
+func (s *testSinks) Health() outbox.Health {
+	return s.health
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestServer(t *testing.T, c *testCrawler, n *testNode, s *testSinks) *Server {
+	srv, err := New(&Config{MaxLag: 5, StallTimeout: "1m"}, c, n, s)
+	if err != nil {
+		t.Fatal("Error creating server: ", err)
+	}
+	return srv
+}
+
+func get(srv *Server, path string, obj interface{}) int {
+	rec := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if obj != nil {
+		json.Unmarshal(rec.Body.Bytes(), obj)
+	}
+	return rec.Code
+}
+
+func TestHealthz(t *testing.T) {
+	c := &testCrawler{status: crawler.Status{LastProgress: time.Now()}}
+	srv := newTestServer(t, c, &testNode{}, &testSinks{})
+	if code := get(srv, "/healthz", nil); code != http.StatusOK {
+		t.Errorf("TestHealthz code = %d; want %d", code, http.StatusOK)
+	}
+	// no progress for longer than the stall timeout
+	c.status.LastProgress = time.Now().Add(-2 * time.Minute)
+	if code := get(srv, "/healthz", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("TestHealthz stalled code = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	// halted after a deep reorg, though still polling
+	c.status.LastProgress = time.Now()
+	c.status.Halted = "reorg deeper than the cache"
+	if code := get(srv, "/healthz", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("TestHealthz halted code = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	c := &testCrawler{status: crawler.Status{Head: crawler.Head{Number: 100}}}
+	n := &testNode{head: 105}
+	srv := newTestServer(t, c, n, &testSinks{})
+
+	var r Readiness
+	if code := get(srv, "/readyz", &r); code != http.StatusOK {
+		t.Errorf("TestReadyz code = %d; want %d", code, http.StatusOK)
+	}
+	if !r.Ready || r.Lag != 5 {
+		t.Errorf("TestReadyz = %+v; want ready with lag 5", r)
+	}
+
+	n.head = 106
+	if code := get(srv, "/readyz", &r); code != http.StatusServiceUnavailable {
+		t.Errorf("TestReadyz lagging code = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+
+	n.err = errors.New("node offline")
+	if code := get(srv, "/readyz", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("TestReadyz offline code = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c := &testCrawler{status: crawler.Status{
+		Head:       crawler.Head{Number: 100, Hash: "0x64"},
+		CacheDepth: 12,
+		Syncing:    true,
+		LastReorg:  &crawler.Reorg{Depth: 2, Ancestor: crawler.Head{Number: 97}},
+	}}
+	s := &testSinks{outbox.Health{Healthy: false, Error: "broker down"}}
+	srv := newTestServer(t, c, &testNode{}, s)
+
+	var st Status
+	if code := get(srv, "/status", &st); code != http.StatusOK {
+		t.Fatalf("TestStatus code = %d; want %d", code, http.StatusOK)
+	}
+	if st.Head.Hash != "0x64" || st.CacheDepth != 12 || !st.Syncing {
+		t.Errorf("TestStatus crawler = %+v", st.Status)
+	}
+	if st.LastReorg == nil || st.LastReorg.Depth != 2 {
+		t.Errorf("TestStatus lastReorg = %+v; want depth 2", st.LastReorg)
+	}
+	if st.Node.Version != "reorgd/v0.0.1" {
+		t.Errorf("TestStatus node version = %s; want reorgd/v0.0.1", st.Node.Version)
+	}
+	if len(st.Node.Nodes) != 1 || !st.Node.Nodes[0].Healthy {
+		t.Errorf("TestStatus nodes = %+v; want 1 healthy", st.Node.Nodes)
+	}
+	if st.Sinks.Healthy || st.Sinks.Error != "broker down" {
+		t.Errorf("TestStatus sinks = %+v; want unhealthy", st.Sinks)
+	}
+}
+
+func TestReorgs(t *testing.T) {
+	c := &testCrawler{reorgs: []common.Reorg{
+		{Ancestor: common.BlockRef{Number: 97, Hash: "0x61"}, Depth: 2},
+		{Ancestor: common.BlockRef{Number: 50, Hash: "0x32"}, Depth: 1},
+	}}
+	srv := newTestServer(t, c, &testNode{}, &testSinks{})
+
+	var reorgs []common.Reorg
+	if code := get(srv, "/reorgs", &reorgs); code != http.StatusOK {
+		t.Fatalf("TestReorgs code = %d; want %d", code, http.StatusOK)
+	}
+	if len(reorgs) != 2 || reorgs[0].Ancestor.Number != 97 {
+		t.Errorf("TestReorgs = %+v; want 2 newest first", reorgs)
+	}
+	if get(srv, "/reorgs?limit=1", &reorgs); len(reorgs) != 1 {
+		t.Errorf("TestReorgs limit = %d; want 1", len(reorgs))
+	}
+	if code := get(srv, "/reorgs?limit=none", nil); code != http.StatusBadRequest {
+		t.Errorf("TestReorgs invalid limit code = %d; want %d", code, http.StatusBadRequest)
+	}
+}
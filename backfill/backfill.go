@@ -0,0 +1,202 @@
+// Package backfill indexes a bounded range of historical blocks, fetching
+// segments of the range in parallel and emitting blocks in order.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/disk"
+	"github.com/iquidus/blockspider/sink"
+)
+
+const (
+	DefaultWorkers     = 4
+	DefaultSegmentSize = 100
+)
+
+var ErrRangeMismatch = errors.New("checkpoint is for a different range")
+
+type Config struct {
+	From        uint64
+	To          uint64
+	Workers     int    // segments fetched in parallel
+	SegmentSize uint64 // blocks per segment
+	Checkpoint  string // path of the checkpoint file
+}
+
+// Checkpoint records backfill progress, written after each segment is emitted
+type Checkpoint struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+	Next uint64 `json:"next"` // next block to emit
+	Hash string `json:"hash"` // hash of the last block emitted
+}
+
+type Backfiller struct {
+	cfg    *Config
+	rpc    *common.RPCClient
+	sink   sink.Sink
+	logger log.Logger
+}
+
+func New(cfg *Config, rpc *common.RPCClient, sink sink.Sink, logger log.Logger) *Backfiller {
+	if cfg.Workers < 1 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.SegmentSize == 0 {
+		cfg.SegmentSize = DefaultSegmentSize
+	}
+	return &Backfiller{cfg, rpc, sink, logger}
+}
+
+// segment of the range, fetched by one worker
+type segment struct {
+	from, to uint64
+	blocks   []common.Block
+	err      error
+	done     chan struct{}
+}
+
+// Run backfills the configured range, resuming from the checkpoint if one
+// exists. Blocks are emitted to the sink in order; progress is checkpointed
+// after each segment so an interrupted run resumes where it stopped.
+func (b *Backfiller) Run(ctx context.Context) error {
+	if b.cfg.From > b.cfg.To {
+		return fmt.Errorf("invalid range: from %d > to %d", b.cfg.From, b.cfg.To)
+	}
+	cp, err := b.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if cp.Next > b.cfg.To {
+		b.logger.Info("Backfill already complete", "from", cp.From, "to", cp.To)
+		return nil
+	}
+	head, err := b.rpc.LatestBlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	if b.cfg.To > head {
+		return fmt.Errorf("invalid range: to %d is beyond chain head %d", b.cfg.To, head)
+	}
+	b.logger.Info("Starting backfill", "from", cp.Next, "to", b.cfg.To, "workers", b.cfg.Workers, "segment", b.cfg.SegmentSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// segments are queued in order, the queue bounds the segments in flight
+	queue := make(chan *segment, b.cfg.Workers-1)
+	go func() {
+		defer close(queue)
+		for from := cp.Next; from <= b.cfg.To; from += b.cfg.SegmentSize {
+			seg := &segment{from: from, to: min(from+b.cfg.SegmentSize-1, b.cfg.To), done: make(chan struct{})}
+			select {
+			case queue <- seg:
+			case <-ctx.Done():
+				return
+			}
+			go b.fetch(ctx, seg)
+			if seg.to == b.cfg.To {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for seg := range queue {
+		select {
+		case <-seg.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if seg.err != nil {
+			return seg.err
+		}
+		if err = b.emit(ctx, seg, &cp); err != nil {
+			return err
+		}
+		if err = disk.WriteCheckedJsonFile(cp, b.cfg.Checkpoint, 0644); err != nil {
+			return err
+		}
+		b.logger.Info("Backfilled segment", "from", seg.from, "to", seg.to, "took", time.Since(start))
+		start = time.Now()
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	b.logger.Info("Backfill complete", "from", b.cfg.From, "to", b.cfg.To)
+	return nil
+}
+
+// fetches and converts each block in a segment
+func (b *Backfiller) fetch(ctx context.Context, seg *segment) {
+	defer close(seg.done)
+	seg.blocks = make([]common.Block, 0, seg.to-seg.from+1)
+	for n := seg.from; n <= seg.to; n++ {
+		raw, err := b.rpc.GetBlockByHeight(ctx, n)
+		if err != nil {
+			seg.err = err
+			return
+		}
+		block, err := b.rpc.ConvertBlock(ctx, &raw)
+		if err != nil {
+			seg.err = err
+			return
+		}
+		seg.blocks = append(seg.blocks, block)
+	}
+}
+
+// writes a segment's blocks to the sink in order, checking they extend the
+// last block emitted
+func (b *Backfiller) emit(ctx context.Context, seg *segment, cp *Checkpoint) error {
+	for i := range seg.blocks {
+		block := &seg.blocks[i]
+		if cp.Hash != "" && block.ParentHash != cp.Hash {
+			return fmt.Errorf("block %d parent %s does not match %s, chain reorganized during backfill", block.Number, block.ParentHash, cp.Hash)
+		}
+		if err := b.sink.Accept(ctx, block); err != nil {
+			return err
+		}
+		cp.Hash = block.Hash
+	}
+	if err := b.sink.Flush(ctx); err != nil {
+		return err
+	}
+	cp.Next = seg.to + 1
+	return nil
+}
+
+// reads the checkpoint for the configured range, or returns a new one
+func (b *Backfiller) loadCheckpoint() (Checkpoint, error) {
+	cp := Checkpoint{From: b.cfg.From, To: b.cfg.To, Next: b.cfg.From}
+	if b.cfg.Checkpoint == "" {
+		return cp, errors.New("checkpoint path not set")
+	}
+	var saved Checkpoint
+	err := disk.ReadCheckedJsonFile[Checkpoint](b.cfg.Checkpoint, &saved)
+	if errors.Is(err, fs.ErrNotExist) {
+		// no checkpoint, start from the beginning
+		return cp, nil
+	} else if err != nil {
+		return cp, err
+	}
+	if saved.From != b.cfg.From || saved.To != b.cfg.To {
+		return cp, fmt.Errorf("%w: %s has %d-%d", ErrRangeMismatch, b.cfg.Checkpoint, saved.From, saved.To)
+	}
+	b.logger.Info("Resuming backfill from checkpoint", "next", saved.Next)
+	return saved, nil
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,172 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/util"
+)
+
+// testChain serves a chain of empty blocks over json-rpc
+type testChain struct {
+	head uint64
+}
+
+func hash(n uint64) string {
+	return fmt.Sprintf("0x%064x", n+1)
+}
+
+func (c *testChain) BlockNumber() string {
+	return util.EncodeUint64(c.head)
+}
+
+func (c *testChain) GetBlockByNumber(number string, full bool) (*common.RawBlock, error) {
+	n := util.DecodeHex(number)
+	if n > c.head {
+		return nil, nil
+	}
+	parent := ""
+	if n > 0 {
+		parent = hash(n - 1)
+	}
+	return &common.RawBlock{
+		Number:       util.EncodeUint64(n),
+		Hash:         hash(n),
+		ParentHash:   parent,
+		Timestamp:    util.EncodeUint64(n * 2),
+		GasUsed:      "0x0",
+		GasLimit:     "0x0",
+		Transactions: []common.RawTransaction{},
+	}, nil
+}
+
+// testSink records accepted blocks, failing once at failAt
+type testSink struct {
+	mu       sync.Mutex
+	failAt   uint64
+	accepted []uint64
+}
+
+func (s *testSink) Accept(ctx context.Context, block *common.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if block.Number == s.failAt {
+		s.failAt = 0
+		return errors.New("sink unavailable")
+	}
+	s.accepted = append(s.accepted, block.Number)
+	return nil
+}
+
+func (s *testSink) Drop(ctx context.Context, block *common.Block) error {
+	return nil
+}
+
+func (s *testSink) Confirm(ctx context.Context, block *common.Block) error {
+	return nil
+}
+
+func (s *testSink) Finalize(ctx context.Context, block *common.Block) error {
+	return nil
+}
+
+func (s *testSink) Reorg(ctx context.Context, reorg *common.Reorg) error {
+	return nil
+}
+
+func (s *testSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func newTestClient(t *testing.T, head uint64) *common.RPCClient {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &testChain{head}); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	client, err := common.NewRPCClient(&common.RPCConfig{Type: "http", Endpoint: ts.URL})
+	if err != nil {
+		t.Fatal("Error creating rpc client: ", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// checks blocks were accepted in order from first to last
+func checkOrdered(t *testing.T, accepted []uint64, first, last uint64) {
+	t.Helper()
+	if uint64(len(accepted)) != last-first+1 {
+		t.Fatalf("accepted %d blocks; want %d", len(accepted), last-first+1)
+	}
+	for i, n := range accepted {
+		if n != first+uint64(i) {
+			t.Fatalf("accepted[%d] = %d; want %d", i, n, first+uint64(i))
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	client := newTestClient(t, 1000)
+	cfg := &Config{From: 10, To: 259, Workers: 4, SegmentSize: 16, Checkpoint: filepath.Join(t.TempDir(), "backfill.json")}
+	out := &testSink{}
+
+	if err := New(cfg, client, out, log.New()).Run(context.Background()); err != nil {
+		t.Fatal("Error running backfill: ", err)
+	}
+	checkOrdered(t, out.accepted, 10, 259)
+
+	// a completed backfill emits nothing when run again
+	out.accepted = nil
+	if err := New(cfg, client, out, log.New()).Run(context.Background()); err != nil {
+		t.Fatal("Error running backfill: ", err)
+	}
+	if len(out.accepted) != 0 {
+		t.Errorf("TestBackfill rerun accepted = %d; want 0", len(out.accepted))
+	}
+}
+
+func TestBackfillResume(t *testing.T) {
+	client := newTestClient(t, 1000)
+	cfg := &Config{From: 0, To: 199, Workers: 3, SegmentSize: 20, Checkpoint: filepath.Join(t.TempDir(), "backfill.json")}
+	out := &testSink{failAt: 130}
+
+	if err := New(cfg, client, out, log.New()).Run(context.Background()); err == nil {
+		t.Fatal("TestBackfillResume err = nil; want error")
+	}
+	checkOrdered(t, out.accepted, 0, 129)
+
+	// resumes from the start of the failed segment
+	out.accepted = nil
+	if err := New(cfg, client, out, log.New()).Run(context.Background()); err != nil {
+		t.Fatal("Error resuming backfill: ", err)
+	}
+	checkOrdered(t, out.accepted, 120, 199)
+
+	// a checkpoint for another range is not reused
+	cfg.To = 299
+	err := New(cfg, client, out, log.New()).Run(context.Background())
+	if !errors.Is(err, ErrRangeMismatch) {
+		t.Errorf("TestBackfillResume err = %v; want %v", err, ErrRangeMismatch)
+	}
+}
+
+func TestBackfillBeyondHead(t *testing.T) {
+	client := newTestClient(t, 100)
+	cfg := &Config{From: 50, To: 150, Checkpoint: filepath.Join(t.TempDir(), "backfill.json")}
+	if err := New(cfg, client, &testSink{}, log.New()).Run(context.Background()); err == nil {
+		t.Error("TestBackfillBeyondHead err = nil; want error")
+	}
+}
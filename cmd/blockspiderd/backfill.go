@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/iquidus/blockspider/backfill"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/internal/sinks"
+	"github.com/iquidus/blockspider/params"
+)
+
+// runBackfill indexes the range given by args without touching the state db,
+// e.g: blockspiderd -c config.json backfill --from 0 --to 1000000
+func runBackfill(ctx context.Context, cfg *params.Config, rpc *common.RPCClient, args []string) error {
+	var bcfg backfill.Config
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.Uint64Var(&bcfg.From, "from", 0, "first block to backfill")
+	fs.Uint64Var(&bcfg.To, "to", 0, "last block to backfill")
+	fs.IntVar(&bcfg.Workers, "workers", backfill.DefaultWorkers, "segments fetched in parallel")
+	fs.Uint64Var(&bcfg.SegmentSize, "segment", backfill.DefaultSegmentSize, "blocks per segment")
+	fs.StringVar(&bcfg.Checkpoint, "checkpoint", "", "checkpoint file (default backfill-<from>-<to>.json next to the state db)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if bcfg.To == 0 {
+		return errors.New("--to is required")
+	}
+	if bcfg.Checkpoint == "" {
+		bcfg.Checkpoint = filepath.Join(filepath.Dir(cfg.State.Path), fmt.Sprintf("backfill-%d-%d.json", bcfg.From, bcfg.To))
+	}
+
+	store, err := sinks.OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	out, err := sinks.New(cfg, store)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	mainLogger.Info("Backfill checkpoint", "path", bcfg.Checkpoint)
+	return backfill.New(&bcfg, rpc, out, appLogger.New("module", "backfill")).Run(ctx)
+}
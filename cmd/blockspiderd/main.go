@@ -1,20 +1,27 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/admin"
 	"github.com/iquidus/blockspider/common"
 	"github.com/iquidus/blockspider/crawler"
 	"github.com/iquidus/blockspider/disk"
-	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/internal/sinks"
+	"github.com/iquidus/blockspider/outbox"
 	"github.com/iquidus/blockspider/params"
 	"github.com/iquidus/blockspider/state"
+	"github.com/iquidus/blockspider/storage"
 )
 
 var (
@@ -76,9 +83,56 @@ func main() {
 
 	mainLogger.Debug("printing config", "cfg", cfg)
 
+	// metrics.addr served /metrics before it moved to the admin api
+	if cfg.Metrics.Addr != "" {
+		if cfg.Admin.Addr != "" && cfg.Admin.Addr != cfg.Metrics.Addr {
+			log.Error("Error: metrics.addr is deprecated and conflicts with admin.addr, remove it and serve /metrics on admin.addr", "metrics.addr", cfg.Metrics.Addr, "admin.addr", cfg.Admin.Addr)
+			os.Exit(1)
+		}
+		log.Warn("metrics.addr is deprecated, use admin.addr", "addr", cfg.Metrics.Addr)
+		cfg.Admin.Addr = cfg.Metrics.Addr
+	}
+	switch cfg.Crawler.Finality {
+	case "", "safe", "finalized":
+	default:
+		log.Error("Error: crawler.finality must be \"safe\" or \"finalized\"", "finality", cfg.Crawler.Finality)
+		os.Exit(1)
+	}
+	switch cfg.Crawler.DeepReorg {
+	case "", crawler.DeepReorgHalt, crawler.DeepReorgRecover:
+	default:
+		log.Error("Error: crawler.deepReorg must be \"halt\" or \"recover\"", "deepReorg", cfg.Crawler.DeepReorg)
+		os.Exit(1)
+	}
+	if cfg.State.CacheLimit > 0 && cfg.Crawler.Confirmations >= uint64(cfg.State.CacheLimit) {
+		log.Error("Error: crawler.confirmations must be less than state.cache", "confirmations", cfg.Crawler.Confirmations, "cache", cfg.State.CacheLimit)
+		os.Exit(1)
+	}
+
+	if cfg.ShutdownTimeout == "" {
+		cfg.ShutdownTimeout = params.DefaultShutdownTimeout
+	}
+	shutdownTimeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		log.Error("Error: could not parse shutdown timeout", "d", cfg.ShutdownTimeout, "err", err)
+		os.Exit(1)
+	}
+
+	// cancelled on SIGINT/SIGTERM to start a graceful shutdown
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	// cancelled when the shutdown timeout expires, aborting work in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// check node connection
-	rpcClient := common.NewRPCClient(&cfg.Rpc)
-	version, err := rpcClient.Ping()
+	rpcClient, err := common.NewRPCClient(&cfg.Rpc)
+	if err != nil {
+		mainLogger.Error("could not create rpc client", "err", err)
+		os.Exit(1)
+	}
+	defer rpcClient.Close()
+	version, err := rpcClient.Ping(ctx)
 	if err != nil {
 		switch err.(type) {
 		case *url.Error:
@@ -91,30 +145,75 @@ func main() {
 
 	mainLogger.Info("connected to rpc server", "version", version)
 
+	// check if node can return all receipts for a block in one call
+	blockReceipts, err := rpcClient.ProbeBlockReceipts(ctx)
+	if err != nil {
+		mainLogger.Warn("could not probe eth_getBlockReceipts", "err", err)
+	}
+	mainLogger.Info("probed rpc capabilities", "eth_getBlockReceipts", blockReceipts)
+
+	switch flag.Arg(0) {
+	case "":
+	case "backfill":
+		if err = runBackfill(sigCtx, &cfg, rpcClient, flag.Args()[1:]); err != nil {
+			log.Error("backfill failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Error("unknown command", "cmd", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	// Open storage backend
+	store, err := sinks.OpenStorage(&cfg)
+	if err != nil {
+		log.Error("could not open storage", "driver", cfg.Storage.Driver, "err", err)
+		os.Exit(1)
+	}
+
 	// Initialize state
 	s, err := state.Init(&cfg.State, &cfg.ChainId)
 	if err != nil {
 		log.Error("could not initialize state", "err", err)
 		os.Exit(1)
 	}
-	// Check if cache is empty
+	// Check if cache is empty, resume from stored head if we have one
+	if s.Cache.Count() == 0 && store != nil {
+		storedHead, err := store.Head(ctx)
+		if err == nil {
+			log.Info("cache is empty, resuming from stored head", "number", storedHead.Number, "hash", storedHead.Hash)
+			// the stored head only has the header fields to resume from, the
+			// full block is fetched so a reorg re-emits it intact
+			rawHead, err := rpcClient.GetBlockByHash(ctx, storedHead.Hash)
+			if err != nil {
+				// ErrBlockNotFound if the node no longer has the block
+				log.Error("could not retrieve stored head from rpc node", "hash", storedHead.Hash, "err", err)
+				os.Exit(1)
+			}
+			head, err := rpcClient.ConvertBlock(ctx, &rawHead)
+			if err != nil {
+				log.Error("could not convert stored head", "err", err)
+				os.Exit(1)
+			}
+			s.Cache.Push(head)
+		} else if err != storage.ErrEmpty {
+			log.Error("could not retrieve stored head", "err", err)
+			os.Exit(1)
+		}
+	}
 	if s.Cache.Count() == 0 {
 		// empty cache, use start block
 		log.Info("cache is empty, using start block", "number", cfg.Crawler.Start)
 		// get start block from rpc
-		rawStartBlock, err := rpcClient.GetBlockByHeight(cfg.Crawler.Start)
+		rawStartBlock, err := rpcClient.GetBlockByHeight(ctx, cfg.Crawler.Start)
 		if err != nil {
-			log.Error("could not retrieve start block", "err", err)
-			os.Exit(1)
-		}
-		if rawStartBlock.Hash == "" {
-			// empty block with no err, possible future blocknumber, abort
-			err = errors.New("block not found")
+			// ErrBlockNotFound if the start block is in the future
 			log.Error("could not retrieve start block", "err", err)
 			os.Exit(1)
 		}
 		// convert to common block
-		startBlock, err := rawStartBlock.Convert(rpcClient, nil)
+		startBlock, err := rawStartBlock.ConvertContext(ctx, rpcClient, nil)
 		if err != nil {
 			log.Error("could not convert start block", "err", err)
 			os.Exit(1)
@@ -131,18 +230,88 @@ func main() {
 		log.Info("resuming from cached block", "number", cachedHead.Number, "hash", cachedHead.Hash)
 	}
 
-	// Create kafka writer
-	kw := kafka.NewWriter(cfg.Kafka.Broker, nil, 1)
+	// Create block sinks
+	out, err := sinks.New(&cfg, store)
+	if err != nil {
+		log.Error("could not create block sink", "err", err)
+		os.Exit(1)
+	}
+
+	// Start delivering outbox messages, including any left from a previous run
+	dispatcher := outbox.New(s, out, appLogger.New("module", "outbox"))
+	dispatcherCtx, stopDispatcher := context.WithCancel(ctx)
+	dispatcherDone := make(chan struct{})
+	go func() {
+		dispatcher.Run(dispatcherCtx)
+		close(dispatcherDone)
+	}()
 
 	// Start crawler
-	go startCrawler(&cfg.Crawler, s, rpcClient, kw, appLogger)
+	blockCrawler := crawler.NewCrawler(&cfg.Crawler, s, rpcClient, dispatcher, appLogger.New())
 
-	quit := make(chan int)
-	<-quit
-}
+	// Serve health, readiness, status and metrics
+	var adminServer *admin.Server
+	if cfg.Admin.Addr != "" {
+		adminServer, err = admin.New(&cfg.Admin, blockCrawler, rpcClient, dispatcher)
+		if err != nil {
+			log.Error("could not create admin server", "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			mainLogger.Info("Serving admin api", "addr", cfg.Admin.Addr)
+			if err := adminServer.ListenAndServe(); err != nil {
+				mainLogger.Error("admin server failed", "err", err)
+			}
+		}()
+	}
+	crawlerErr := make(chan error, 1)
+	go func() {
+		mainLogger.Info("Starting crawler")
+		crawlerErr <- blockCrawler.Run(ctx)
+	}()
 
-func startCrawler(cfg *crawler.Config, s *state.State, rpc *common.RPCClient, writer *kafka.Writer, logger log.Logger) {
-	blockCrawler := crawler.NewCrawler(cfg, s, rpc, writer, logger.New())
-	logger.Info("Starting crawler")
-	crawler.Start(blockCrawler, cfg, logger)
+	select {
+	case <-sigCtx.Done():
+		mainLogger.Info("Shutting down", "timeout", shutdownTimeout)
+	case err = <-crawlerErr:
+		mainLogger.Error("crawler stopped", "err", err)
+		crawlerErr <- err
+	}
+	stopSignals()
+
+	// drain blocks in flight and deliver their messages within the timeout,
+	// anything left is cancelled and resynced on restart
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	var errs []error
+	if err = blockCrawler.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("crawler: %w", err))
+	}
+	cancel()
+	<-crawlerErr
+	// stop the dispatcher, then deliver what's left
+	stopDispatcher()
+	<-dispatcherDone
+	if err = dispatcher.Deliver(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("outbox: %w", err))
+	}
+	if err = s.Save(); err != nil {
+		errs = append(errs, fmt.Errorf("state: %w", err))
+	}
+	if err = s.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("state: %w", err))
+	}
+	if err = out.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("sink: %w", err))
+	}
+	if adminServer != nil {
+		if err = adminServer.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("admin: %w", err))
+		}
+	}
+	if err = errors.Join(errs...); err != nil {
+		mainLogger.Error("unclean shutdown", "err", err)
+		os.Exit(1)
+	}
+	mainLogger.Info("Shutdown complete")
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -42,7 +43,7 @@ func init() {
 
 func generateReceipts(rpc *common.RPCClient) {
 	// get block by number
-	rawBlock, err := rpc.GetBlockByHeight(height)
+	rawBlock, err := rpc.GetBlockByHeight(context.Background(), height)
 	if err != nil {
 		log.Fatal("Error during Unmarshal(): ", err)
 	}
@@ -52,13 +53,13 @@ func generateReceipts(rpc *common.RPCClient) {
 		log.Fatal("Error writing to file: ", err)
 	}
 	// get transaction receipts
-	receipts := make([]common.RawTransactionReceipt, len(rawBlock.Transactions))
+	hashes := make([]string, len(rawBlock.Transactions))
 	for i, txn := range rawBlock.Transactions {
-		receipt, err := rpc.GetTransactionReceipt(txn.Hash)
-		if err != nil {
-			log.Fatal("Error during Unmarshal(): ", err)
-		}
-		receipts[i] = *receipt
+		hashes[i] = txn.Hash
+	}
+	receipts, err := rpc.GetTransactionReceipts(context.Background(), hashes)
+	if err != nil {
+		log.Fatal("Error during Unmarshal(): ", err)
 	}
 	// write receipts to file
 	err = disk.WriteJsonFile[[]common.RawTransactionReceipt](receipts, fmt.Sprintf("./testdata/eth-txn-receipts-%d.json", height), 0644)
@@ -79,6 +80,9 @@ func main() {
 	if err != nil {
 		mainLogger.Fatal("Error: could read config file", "err", err)
 	}
-	rpcClient := common.NewRPCClient(&cfg.Rpc)
+	rpcClient, err := common.NewRPCClient(&cfg.Rpc)
+	if err != nil {
+		mainLogger.Fatal("Error: could not create rpc client", "err", err)
+	}
 	generateReceipts(rpcClient)
 }
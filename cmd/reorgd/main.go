@@ -1,253 +1,223 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"math/big"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/gin-gonic/gin"
-	"github.com/iquidus/blockspider/cache"
-	"github.com/iquidus/blockspider/common"
-	"github.com/iquidus/blockspider/util"
-	"golang.org/x/crypto/sha3"
+	"github.com/iquidus/blockspider/disk"
+	"github.com/iquidus/blockspider/fakenode"
 )
 
-const (
-	BLOCKTIME = 2     // desired block time in seconds
-	JSONRPC   = "2.0" // const for rpc responses
-)
-
-// some reusable bigInts
 var (
-	big1    = big.NewInt(1)
-	big5    = big.NewInt(5)
-	big7    = big.NewInt(7)
-	big2048 = big.NewInt(2048)
+	port         int
+	blockTime    time.Duration
+	seed         int64
+	odds         float64
+	maxDepth     int
+	scenarioFile string
+	maxTxs       int
+	accounts     int
+	erc20        string
+	erc721       string
+	logLevel     string
 )
 
-type Request struct {
-	Id      string        `json:"id"`
-	Jsonrpc string        `json:"jsonrpc"`
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
-}
+const (
+	portFlagDefault = 8079
+	portFlagDesc    = "port to serve json-rpc and the control api on"
 
-type Response struct {
-	Id      string        `json:"id"`
-	Jsonrpc string        `json:"jsonrpc"`
-	Result  string        `json:"result,omitempty"`
-	Error   *JsonRpcError `json:"error,omitempty"`
-}
+	blockTimeFlagDefault = 2 * time.Second
+	blockTimeFlagDesc    = "time between mined blocks, 0 to only mine from the control api"
 
-type BlockResponse struct {
-	Id      string           `json:"id"`
-	Jsonrpc string           `json:"jsonrpc"`
-	Result  *common.RawBlock `json:"result"`
-	Error   *JsonRpcError    `json:"error,omitempty"`
-}
+	seedFlagDefault = 0
+	seedFlagDesc    = "seed for random reorgs and transactions, 0 for a random seed"
 
-type LogResponse struct {
-	Id      string   `json:"id"`
-	Jsonrpc string   `json:"jsonrpc"`
-	Result  []string `json:"result"`
-}
+	oddsFlagDefault = 0.16
+	oddsFlagDesc    = "probability of a random reorg before each block, 0 to disable"
 
-type JsonRpcError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-}
+	depthFlagDefault = 5
+	depthFlagDesc    = "max depth of random reorgs"
+
+	scenarioFlagDefault = ""
+	scenarioFlagDesc    = "json file of scenario steps, disables random reorgs unless -reorg is also set"
+
+	txsFlagDefault = 10
+	txsFlagDesc    = "max transactions in each block, 0 for empty blocks"
+
+	accountsFlagDefault = 20
+	accountsFlagDesc    = "number of accounts sending and receiving transactions"
+
+	erc20FlagDefault = ""
+	erc20FlagDesc    = "comma separated ERC-20 contract addresses to generate transfers on"
 
-// returns a random keccak256 hash with 0x prefix
-func randomKeccakHash() string {
-	var seed, _ = rand.Int(rand.Reader, big2048)
-	var hash = sha3.NewLegacyKeccak256()
-	hash.Write(seed.Bytes())
-	keccak := hash.Sum(nil)
-	return fmt.Sprintf("0x%x", keccak)
+	erc721FlagDefault = ""
+	erc721FlagDesc    = "comma separated ERC-721 contract addresses to generate transfers on"
+
+	logLevelFlagDefault = "info"
+	logLevelFlagDesc    = "set level of logs"
+)
+
+func init() {
+	flag.IntVar(&port, "p", portFlagDefault, portFlagDesc)
+	flag.IntVar(&port, "port", portFlagDefault, portFlagDesc)
+
+	flag.DurationVar(&blockTime, "blocktime", blockTimeFlagDefault, blockTimeFlagDesc)
+	flag.Int64Var(&seed, "seed", seedFlagDefault, seedFlagDesc)
+	flag.Float64Var(&odds, "reorg", oddsFlagDefault, oddsFlagDesc)
+	flag.IntVar(&maxDepth, "depth", depthFlagDefault, depthFlagDesc)
+	flag.StringVar(&scenarioFile, "scenario", scenarioFlagDefault, scenarioFlagDesc)
+	flag.IntVar(&maxTxs, "txs", txsFlagDefault, txsFlagDesc)
+	flag.IntVar(&accounts, "accounts", accountsFlagDefault, accountsFlagDesc)
+	flag.StringVar(&erc20, "erc20", erc20FlagDefault, erc20FlagDesc)
+	flag.StringVar(&erc721, "erc721", erc721FlagDefault, erc721FlagDesc)
+
+	flag.StringVar(&logLevel, "ll", logLevelFlagDefault, logLevelFlagDesc)
+	flag.StringVar(&logLevel, "logLevel", logLevelFlagDefault, logLevelFlagDesc)
 }
 
-// returns a dummy PoW block chained with the given parent block
-func createPowBlock(parent *common.RawBlock) common.RawBlock {
-	// start as if genesis
-	var number uint64 = 0
-	var parentHash string = "0x"
-	timestamp := util.EncodeUint64(uint64(time.Now().Unix()))
-
-	// check if a parent block is provided
-	if parent != nil {
-		// chain new block to parent
-		number = util.DecodeHex(parent.Number)
-		number++
-		parentHash = parent.Hash
+// reads the scenario steps, e.g: [{"height": 50, "reorg": 3}]
+func readScenario(path string) ([]Step, error) {
+	steps := []Step{}
+	if err := disk.ReadJsonFile[[]Step](path, &steps); err != nil {
+		return nil, err
 	}
+	for _, step := range steps {
+		if step.Reorg < 0 || uint64(step.Reorg) > step.Height {
+			return nil, fmt.Errorf("step at height %d: reorg depth %d must be between 0 and the height", step.Height, step.Reorg)
+		}
+	}
+	return steps, nil
+}
 
-	// generate a random "blockhash"
-	var hash = randomKeccakHash()
-	// return a block
-	return common.RawBlock{
-		Number:     util.EncodeUint64(number),
-		Timestamp:  timestamp,
-		Hash:       hash,
-		ParentHash: parentHash,
-		// TODO(iquidus): randomly generate values below
-		Difficulty:      util.EncodeUint64(uint64(438231850248)),
-		TotalDifficulty: util.EncodeUint64(uint64(2142877125748580710)),
-		Size:            util.EncodeUint64(uint64(542)),
-		GasUsed:         util.EncodeUint64(uint64(0)),
-		GasLimit:        util.EncodeUint64(uint64(8000000)),
-		Nonce:           util.EncodeUint64(number),
-		BaseFeePerGas:   util.EncodeUint64(uint64(80000000)),
-		ExtraData:       "0x",
+// parses a comma separated list of contract addresses
+func parseAddresses(list string) ([]string, error) {
+	var addresses []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.ToLower(strings.TrimSpace(addr))
+		if addr == "" {
+			continue
+		}
+		if !ethcommon.IsHexAddress(addr) || !strings.HasPrefix(addr, "0x") {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		addresses = append(addresses, addr)
 	}
+	return addresses, nil
 }
 
 // main function (app entry)
 func main() {
-	// create a "blockchain" (a block stack using a doubly-linked list)
-	blockchain := cache.New[common.RawBlock](nil)
-	// create a map for faster lookups by block number
-	blockmap := make(map[string]common.RawBlock)
-	// generate a genesis block (no parent block)
-	genesis := createPowBlock(nil)
-	// add to blockchain
-	blockchain.Push(genesis)
-	blockmap[genesis.Number] = genesis
-
-	// start "miner"
-	miner := time.NewTicker(BLOCKTIME * time.Second)
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			case <-miner.C:
-				// roll a dice to determine reorg length (1-6 blocks)
-				diceRoll1, _ := rand.Int(rand.Reader, big5)
-				diceRoll1.Add(diceRoll1, big1)
-				reorgLength := diceRoll1.Uint64()
-				// make sure theres enough blocks in chain for this reorg
-				if uint64(blockchain.Count()) > reorgLength {
-					// roll a second dice (1-6)
-					diceRoll2, _ := rand.Int(rand.Reader, big5)
-					diceRoll2.Add(diceRoll2, big1)
-					// combine results of both dice rolls
-					diceRollCombined := big.NewInt(0)
-					diceRollCombined.Add(diceRoll1, diceRoll2)
-					// if we have rolled a 7, reorg
-					if diceRollCombined.Cmp(big7) == 0 {
-						// drop old blocks
-						for i := 0; i < int(reorgLength); i++ {
-							oldBlock, _ := blockchain.Pop()
-							delete(blockmap, oldBlock.Number)
-							fmt.Printf("Dropped old block, number: %d, hash: %s\n", util.DecodeHex(oldBlock.Number), oldBlock.Hash)
-						}
-						// add new blocks
-						for i := 0; i < int(reorgLength); i++ {
-							parent, _ := blockchain.Peak()
-							newBlock := createPowBlock(&parent)
-							blockchain.Push(newBlock)
-							blockmap[newBlock.Number] = newBlock
-							fmt.Printf("Mined new block, number: %d, hash: %s\n", util.DecodeHex(newBlock.Number), newBlock.Hash)
-						}
-					}
-				}
-				// create a new block using the chains head as parent
-				parent, _ := blockchain.Peak()
-				newBlock := createPowBlock(&parent)
-				// add block to chain
-				blockchain.Push(newBlock)
-				blockmap[newBlock.Number] = newBlock
-				// log
-				fmt.Printf("Mined new block, number: %d, hash: %s\n", util.DecodeHex(newBlock.Number), newBlock.Hash)
-			}
+	// parsed here rather than in init so the tests can set their own flags
+	flag.Parse()
+
+	handler := log.NewGlogHandler(log.StreamHandler(os.Stdout, log.TerminalFormat(true)))
+	if logLevel == "debug" || logLevel == "d" || logLevel == "dbg" {
+		handler.Verbosity(log.LvlDebug)
+	} else {
+		handler.Verbosity(log.LvlInfo)
+	}
+	log.Root().SetHandler(handler)
+
+	if maxDepth <= 0 {
+		log.Crit("Invalid reorg depth", "depth", maxDepth)
+	}
+	if accounts <= 0 {
+		log.Crit("Invalid number of accounts", "accounts", accounts)
+	}
+	erc20Addresses, err := parseAddresses(erc20)
+	if err != nil {
+		log.Crit("Invalid ERC-20 contracts", "err", err)
+	}
+	erc721Addresses, err := parseAddresses(erc721)
+	if err != nil {
+		log.Crit("Invalid ERC-721 contracts", "err", err)
+	}
+	reorgSet := false
+	flag.Visit(func(f *flag.Flag) { reorgSet = reorgSet || f.Name == "reorg" })
+
+	var scenario []Step
+	if scenarioFile != "" {
+		if scenario, err = readScenario(scenarioFile); err != nil {
+			log.Crit("Error reading scenario", "file", scenarioFile, "err", err)
+		}
+		if !reorgSet {
+			odds = 0
 		}
-	}()
-	// start api
-	router := setupRouter(blockchain, blockmap)
-	router.Run(":8079")
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Info("Starting reorgd", "port", port, "blocktime", blockTime, "seed", seed, "reorg", odds, "depth", maxDepth, "steps", len(scenario), "txs", maxTxs, "erc20", len(erc20Addresses), "erc721", len(erc721Addresses))
+
+	txs := newTxGenerator(seed, maxTxs, accounts, erc20Addresses, erc721Addresses)
+	node := fakenode.New(&fakenode.Config{Txs: txs.Txs, Now: time.Now})
+	m := newMiner(node, seed, odds, maxDepth, scenario)
+
+	if blockTime > 0 {
+		go func() {
+			for range time.Tick(blockTime) {
+				m.tick()
+			}
+		}()
+	}
+
+	router := setupRouter(node, m)
+	if err := router.Run(fmt.Sprintf(":%d", port)); err != nil {
+		log.Crit("Error serving", "err", err)
+	}
 }
 
-func setupRouter(blockchain *cache.BlockStack[common.RawBlock], blockmap map[string]common.RawBlock) *gin.Engine {
+// serves json-rpc on / and the control api on /control
+func setupRouter(node *fakenode.Node, m *miner) *gin.Engine {
 	router := gin.Default()
 	router.ForwardedByClientIP = true
 	router.SetTrustedProxies([]string{"127.0.0.1"})
 
-	router.POST("/", func(c *gin.Context) {
-		body, _ := io.ReadAll(c.Request.Body)
-		var req Request
-		json.Unmarshal(body, &req)
-
-		switch req.Method {
-		case "web3_clientVersion":
-			var res Response
-			res.Id = req.Id
-			res.Jsonrpc = "2.0"
-			res.Result = "Reorgd/v0.0.1-develop"
-			res.Error = nil
-			c.JSON(http.StatusOK, res)
-		case "eth_blockNumber":
-			// return number of head block (as hex string)
-			head, err := blockchain.Peak()
-			if err == nil {
-				res := Response{
-					Id:      req.Id,
-					Jsonrpc: JSONRPC,
-					Result:  head.Number,
-					Error:   nil,
-				}
-				c.JSON(http.StatusOK, res)
-			} else {
-				c.JSON(http.StatusOK, "0x0")
-			}
-		case "eth_getBlockByNumber":
-			res := BlockResponse{Id: req.Id, Jsonrpc: JSONRPC, Result: nil}
-			// get blocknumber (hex string) value from params
-			// if key in blockmap exists return block as result
-			bn := fmt.Sprintf("%v", req.Params[0])
-			switch bn {
-			case "latest":
-				b, err := blockchain.Peak()
-				if err == nil {
-					res.Result = &b
-				}
-			case "earliest":
-				b, ok := blockmap["0x0"]
-				if ok {
-					res.Result = &b
-				}
-			case "pending":
-				res.Error.Code = -39001
-				res.Error.Message = "-39001: Unknown block"
-			case "finalized":
-				res.Error.Code = -39001
-				res.Error.Message = "-39001: Unknown block"
-			case "safe":
-				res.Error.Code = -39001
-				res.Error.Message = "-39001: Unknown block"
-			default:
-				b, ok := blockmap[bn]
-				if ok {
-					res.Result = &b
-				}
-			}
-			c.JSON(http.StatusOK, res)
-		case "eth_getLogs":
-			// TODO(iquidus): generate random (but useful) log data (e.g: random erc20 transfers)
-			res := LogResponse{Id: req.Id, Jsonrpc: JSONRPC}
-			logs := make([]string, 0)
-			res.Result = logs
-			c.JSON(http.StatusOK, res)
-		default:
-			// TODO(iquidus): handle this properly
-			fmt.Printf("Unhandled method: %s, params: %v", req.Method, req.Params)
-			c.JSON(http.StatusOK, nil)
+	router.POST("/", gin.WrapH(node.Handler()))
+
+	control := router.Group("/control")
+	control.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, m.Status())
+	})
+	control.POST("/mine", func(c *gin.Context) {
+		count, err := strconv.Atoi(c.DefaultQuery("count", "1"))
+		if err == nil {
+			err = m.Mine(count)
+		}
+		respond(c, m, err)
+	})
+	control.POST("/reorg", func(c *gin.Context) {
+		depth, err := strconv.Atoi(c.Query("depth"))
+		if err == nil {
+			err = m.Reorg(depth)
 		}
+		respond(c, m, err)
+	})
+	control.POST("/pause", func(c *gin.Context) {
+		m.Pause(true)
+		respond(c, m, nil)
+	})
+	control.POST("/resume", func(c *gin.Context) {
+		m.Pause(false)
+		respond(c, m, nil)
 	})
 
 	return router
 }
+
+// responds with the miner's status, or a bad request error
+func respond(c *gin.Context, m *miner, err error) {
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, m.Status())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/fakenode"
+	"github.com/iquidus/blockspider/util"
+)
+
+// Step is a scenario step, run when the head reaches Height. Reorg replaces
+// the last Reorg blocks (the head and the blocks below it) before the next
+// block is mined, Pause stops the miner until it is resumed.
+type Step struct {
+	Height uint64 `json:"height"`
+	Reorg  int    `json:"reorg"`
+	Pause  bool   `json:"pause"`
+}
+
+// maxMineCount caps the blocks mined by one Mine call, the miner is locked
+// until they are all mined
+const maxMineCount = 1000
+
+// Status is returned by the control api
+type Status struct {
+	Head   uint64 `json:"head"`
+	Hash   string `json:"hash"`
+	Paused bool   `json:"paused"`
+	Reorgs int    `json:"reorgs"`
+}
+
+// miner mines a block on the node every tick. Before each block the chain is
+// reorganised by the scenario step at the head, if any, and at random with
+// probability odds.
+type miner struct {
+	node     *fakenode.Node
+	rand     *rand.Rand
+	odds     float64
+	maxDepth int
+
+	mu       sync.Mutex
+	scenario []Step // sorted by height, steps already run are removed
+	paused   bool
+	reorgs   int
+}
+
+func newMiner(node *fakenode.Node, seed int64, odds float64, maxDepth int, scenario []Step) *miner {
+	sort.SliceStable(scenario, func(i, j int) bool { return scenario[i].Height < scenario[j].Height })
+	return &miner{
+		node:     node,
+		rand:     rand.New(rand.NewSource(seed)),
+		odds:     odds,
+		maxDepth: maxDepth,
+		scenario: scenario,
+	}
+}
+
+// tick mines the next block unless the miner is paused
+func (m *miner) tick() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused {
+		return
+	}
+
+	head := m.head()
+	scripted := false
+	for len(m.scenario) > 0 && m.scenario[0].Height <= head {
+		step := m.scenario[0]
+		m.scenario = m.scenario[1:]
+		if step.Height < head {
+			log.Warn("Skipped scenario step below head", "height", step.Height, "head", head)
+			continue
+		}
+		if step.Reorg > 0 {
+			scripted = true
+			if err := m.reorg(step.Reorg); err != nil {
+				log.Error("Error running scenario step", "height", step.Height, "err", err)
+			}
+		}
+		if step.Pause {
+			log.Info("Paused by scenario", "height", step.Height)
+			m.paused = true
+			return
+		}
+	}
+	if !scripted && m.odds > 0 && m.rand.Float64() < m.odds {
+		if depth := 1 + m.rand.Intn(m.maxDepth); uint64(depth) <= head {
+			m.reorg(depth)
+		}
+	}
+	m.mine(1)
+}
+
+// returns the head block number. Must be called with mu held.
+func (m *miner) head() uint64 {
+	return util.DecodeHex(m.node.Head().Number)
+}
+
+// mines count blocks. Must be called with mu held.
+func (m *miner) mine(count int) {
+	for i := 0; i < count; i++ {
+		m.node.Mine(1)
+		head := m.node.Head()
+		log.Info("Mined new block", "number", util.DecodeHex(head.Number), "hash", head.Hash)
+	}
+}
+
+// replaces the last depth blocks. Must be called with mu held.
+func (m *miner) reorg(depth int) error {
+	old := m.node.Head()
+	if err := m.node.Reorg(depth); err != nil {
+		return err
+	}
+	m.reorgs++
+	head := m.node.Head()
+	log.Info("Reorganised chain", "depth", depth, "number", util.DecodeHex(head.Number), "old", old.Hash, "hash", head.Hash)
+	return nil
+}
+
+// Mine mines count blocks now, whether or not the miner is paused
+func (m *miner) Mine(count int) error {
+	if count <= 0 || count > maxMineCount {
+		return fmt.Errorf("count %d must be between 1 and %d", count, maxMineCount)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mine(count)
+	return nil
+}
+
+// Reorg replaces the last depth blocks now
+func (m *miner) Reorg(depth int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reorg(depth)
+}
+
+// Pause stops or resumes mining on each tick
+func (m *miner) Pause(paused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused = paused
+}
+
+func (m *miner) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	head := m.node.Head()
+	return Status{
+		Head:   util.DecodeHex(head.Number),
+		Hash:   head.Hash,
+		Paused: m.paused,
+		Reorgs: m.reorgs,
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/iquidus/blockspider/fakenode"
+	"github.com/iquidus/blockspider/util"
+)
+
+func newTestMiner(seed int64, odds float64, scenario []Step) (*miner, *fakenode.Node) {
+	txs := newTxGenerator(seed, 5, 4, []string{"0x" + strings.Repeat("20", 20)}, []string{"0x" + strings.Repeat("72", 20)})
+	node := fakenode.New(&fakenode.Config{Txs: txs.Txs})
+	return newMiner(node, seed, odds, 3, scenario), node
+}
+
+func ticks(m *miner, n int) {
+	for i := 0; i < n; i++ {
+		m.tick()
+	}
+}
+
+func hashAt(t *testing.T, node *fakenode.Node, number uint64) string {
+	t.Helper()
+	b, ok := node.Block(number)
+	if !ok {
+		t.Fatalf("block %d not mined", number)
+	}
+	return b.Hash
+}
+
+func TestMinerScenario(t *testing.T) {
+	// steps are run in height order whatever order they are listed in
+	m, node := newTestMiner(1, 0, []Step{{Height: 3, Reorg: 2}, {Height: 1, Reorg: 1}})
+	ticks(m, 1)
+	first := hashAt(t, node, 1)
+	ticks(m, 1)
+	if hashAt(t, node, 1) == first || m.Status().Reorgs != 1 {
+		t.Errorf("TestMinerScenario block 1 = %s, %d reorgs; want replaced at height 1", first, m.Status().Reorgs)
+	}
+
+	ticks(m, 1)
+	one, two, three := hashAt(t, node, 1), hashAt(t, node, 2), hashAt(t, node, 3)
+	ticks(m, 1)
+	if hashAt(t, node, 1) != one || hashAt(t, node, 2) == two || hashAt(t, node, 3) == three {
+		t.Error("TestMinerScenario want blocks 2 and 3 replaced at height 3")
+	}
+	if status := m.Status(); status.Head != 4 || status.Reorgs != 2 {
+		t.Errorf("TestMinerScenario status = %+v; want head 4, 2 reorgs", status)
+	}
+	if len(m.scenario) != 0 {
+		t.Errorf("TestMinerScenario scenario = %+v; want every step run", m.scenario)
+	}
+}
+
+func TestMinerSkippedStep(t *testing.T) {
+	m, node := newTestMiner(1, 0, []Step{{Height: 2, Reorg: 1}, {Height: 6, Reorg: 1}})
+	node.Mine(5)
+	// the step below the head is skipped, the one at the head is run
+	ticks(m, 2)
+	if status := m.Status(); status.Head != 7 || status.Reorgs != 1 {
+		t.Errorf("TestMinerSkippedStep status = %+v; want head 7, 1 reorg", status)
+	}
+	if len(m.scenario) != 0 {
+		t.Errorf("TestMinerSkippedStep scenario = %+v; want every step removed", m.scenario)
+	}
+}
+
+func TestMinerPause(t *testing.T) {
+	m, _ := newTestMiner(1, 0, []Step{{Height: 2, Pause: true}})
+	ticks(m, 5)
+	if status := m.Status(); status.Head != 2 || !status.Paused {
+		t.Errorf("TestMinerPause status = %+v; want paused at 2", status)
+	}
+
+	// mining from the control api carries on while paused
+	if err := m.Mine(2); err != nil {
+		t.Fatal("Error mining: ", err)
+	}
+	ticks(m, 1)
+	if head := m.Status().Head; head != 4 {
+		t.Errorf("TestMinerPause head = %d; want 4", head)
+	}
+
+	m.Pause(false)
+	ticks(m, 1)
+	if status := m.Status(); status.Head != 5 || status.Paused {
+		t.Errorf("TestMinerPause status = %+v; want resumed at 5", status)
+	}
+}
+
+func TestMinerSeed(t *testing.T) {
+	mine := func(seed int64) *fakenode.Node {
+		m, node := newTestMiner(seed, 0.5, nil)
+		ticks(m, 50)
+		return node
+	}
+	a, b := mine(42), mine(42)
+	for i := uint64(0); i <= 50; i++ {
+		blockA, _ := a.Block(i)
+		blockB, _ := b.Block(i)
+		if !reflect.DeepEqual(blockA, blockB) || !reflect.DeepEqual(a.Receipts(i), b.Receipts(i)) {
+			t.Fatalf("TestMinerSeed block %d = %s, %s; want the same chain from the same seed", i, blockA.Hash, blockB.Hash)
+		}
+	}
+	if c := mine(43); reflect.DeepEqual(a.Head(), c.Head()) {
+		t.Error("TestMinerSeed want a different chain from a different seed")
+	}
+}
+
+func TestControlApi(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	m, node := newTestMiner(1, 0, nil)
+	ts := httptest.NewServer(setupRouter(node, m))
+	defer ts.Close()
+
+	request := func(method, path string) (int, Status) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal("Error creating request: ", err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Error requesting: ", err)
+		}
+		defer res.Body.Close()
+		var status Status
+		json.NewDecoder(res.Body).Decode(&status)
+		return res.StatusCode, status
+	}
+
+	tests := []struct {
+		method, path string
+		code         int
+		head         uint64
+		reorgs       int
+		paused       bool
+	}{
+		{"GET", "/control/status", 200, 0, 0, false},
+		{"POST", "/control/mine?count=3", 200, 3, 0, false},
+		{"POST", "/control/mine", 200, 4, 0, false},
+		{"POST", "/control/mine?count=0", 400, 4, 0, false},
+		{"POST", fmt.Sprintf("/control/mine?count=%d", maxMineCount+1), 400, 4, 0, false},
+		{"POST", "/control/reorg?depth=2", 200, 4, 1, false},
+		{"POST", "/control/reorg?depth=5", 400, 4, 1, false},
+		{"POST", "/control/reorg", 400, 4, 1, false},
+		{"POST", "/control/pause", 200, 4, 1, true},
+		{"POST", "/control/resume", 200, 4, 1, false},
+	}
+	for _, tt := range tests {
+		code, _ := request(tt.method, tt.path)
+		if code != tt.code {
+			t.Errorf("TestControlApi %s %s = %d; want %d", tt.method, tt.path, code, tt.code)
+		}
+		if _, status := request("GET", "/control/status"); status.Head != tt.head || status.Reorgs != tt.reorgs || status.Paused != tt.paused {
+			t.Errorf("TestControlApi %s %s status = %+v; want head %d, %d reorgs, paused %v", tt.method, tt.path, status, tt.head, tt.reorgs, tt.paused)
+		}
+	}
+
+	// json-rpc is served on /
+	res, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`))
+	if err != nil {
+		t.Fatal("Error requesting: ", err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		Result string `json:"result"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil || util.DecodeHex(body.Result) != 4 {
+		t.Errorf("TestControlApi eth_blockNumber = %s, %v; want 0x4", body.Result, err)
+	}
+}
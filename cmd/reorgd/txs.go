@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strings"
+
+	"github.com/iquidus/blockspider/fakenode"
+)
+
+const (
+	// Transfer(address,address,uint256), the same topic for ERC-20 and ERC-721
+	transferTopic = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+
+	transferSelector     = "0xa9059cbb" // transfer(address,uint256)
+	transferFromSelector = "0x23b872dd" // transferFrom(address,address,uint256)
+	mintSelector         = "0x6a627842" // mint(address)
+
+	// gas used by each kind of transaction
+	etherGas  = 21000
+	erc20Gas  = 51000
+	erc721Gas = 85000
+)
+
+var zeroAddress = "0x" + strings.Repeat("0", 40)
+
+// txGenerator generates the transactions of each mined block: ether
+// transfers between a fixed set of accounts, and ERC-20 and ERC-721 transfers
+// on the configured contracts with matching Transfer logs
+type txGenerator struct {
+	rand     *rand.Rand
+	maxTxs   int
+	accounts []string
+	erc20    []string
+	erc721   []string
+	tokenIds map[string]uint64 // last ERC-721 token minted by each contract
+}
+
+func newTxGenerator(seed int64, maxTxs, accounts int, erc20, erc721 []string) *txGenerator {
+	g := &txGenerator{
+		rand:     rand.New(rand.NewSource(seed)),
+		maxTxs:   maxTxs,
+		erc20:    erc20,
+		erc721:   erc721,
+		tokenIds: make(map[string]uint64),
+	}
+	for i := 0; i < accounts; i++ {
+		var addr [20]byte
+		g.rand.Read(addr[:])
+		g.accounts = append(g.accounts, fmt.Sprintf("0x%x", addr))
+	}
+	return g
+}
+
+// Txs returns up to maxTxs transactions, the genesis block is empty. It is
+// called by the node with its lock held so is never called concurrently.
+func (g *txGenerator) Txs(number uint64) []fakenode.Tx {
+	if number == 0 || g.maxTxs <= 0 {
+		return nil
+	}
+	txs := make([]fakenode.Tx, g.rand.Intn(g.maxTxs+1))
+	for i := range txs {
+		from, to := g.account(), g.account()
+		switch kind := g.rand.Intn(3); {
+		case kind == 1 && len(g.erc20) > 0:
+			txs[i] = g.erc20Transfer(from, to)
+		case kind == 2 && len(g.erc721) > 0:
+			txs[i] = g.erc721Transfer(from, to)
+		default:
+			txs[i] = fakenode.Tx{From: from, To: to, Value: g.rand.Uint64() >> 4, Gas: etherGas}
+		}
+	}
+	return txs
+}
+
+func (g *txGenerator) account() string {
+	return g.accounts[g.rand.Intn(len(g.accounts))]
+}
+
+func (g *txGenerator) erc20Transfer(from, to string) fakenode.Tx {
+	token := g.erc20[g.rand.Intn(len(g.erc20))]
+	amount := new(big.Int).Mul(big.NewInt(g.rand.Int63n(1000000)+1), big.NewInt(1e15))
+	return fakenode.Tx{
+		From:  from,
+		To:    token,
+		Input: transferSelector + word(to) + wordInt(amount),
+		Gas:   erc20Gas,
+		Logs: []fakenode.Log{{
+			Address: token,
+			Topics:  []string{transferTopic, "0x" + word(from), "0x" + word(to)},
+			Data:    "0x" + wordInt(amount),
+		}},
+	}
+}
+
+// transfers an existing token, or mints a new one from the zero address
+func (g *txGenerator) erc721Transfer(from, to string) fakenode.Tx {
+	token := g.erc721[g.rand.Intn(len(g.erc721))]
+	var owner, input string
+	var id uint64
+	if g.tokenIds[token] == 0 || g.rand.Intn(4) == 0 {
+		g.tokenIds[token]++
+		owner, id = zeroAddress, g.tokenIds[token]
+		input = mintSelector + word(to)
+	} else {
+		owner, id = from, 1+uint64(g.rand.Int63n(int64(g.tokenIds[token])))
+		input = transferFromSelector + word(owner) + word(to) + wordInt(new(big.Int).SetUint64(id))
+	}
+	return fakenode.Tx{
+		From:  from,
+		To:    token,
+		Input: input,
+		Gas:   erc721Gas,
+		Logs: []fakenode.Log{{
+			Address: token,
+			Topics:  []string{transferTopic, "0x" + word(owner), "0x" + word(to), "0x" + wordInt(new(big.Int).SetUint64(id))},
+			Data:    "0x",
+		}},
+	}
+}
+
+// returns an address left padded to a 32 byte abi word, without 0x
+func word(addr string) string {
+	return strings.Repeat("0", 24) + strings.TrimPrefix(addr, "0x")
+}
+
+func wordInt(v *big.Int) string {
+	return fmt.Sprintf("%064x", v)
+}
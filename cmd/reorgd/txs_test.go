@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iquidus/blockspider/fakenode"
+	"github.com/iquidus/blockspider/util"
+)
+
+func TestTxsReceipts(t *testing.T) {
+	erc20, erc721 := "0x"+strings.Repeat("20", 20), "0x"+strings.Repeat("72", 20)
+	txs := newTxGenerator(7, 10, 5, []string{erc20}, []string{erc721})
+	node := fakenode.New(&fakenode.Config{Txs: txs.Txs})
+	node.Mine(30)
+
+	kinds := make(map[string]int)
+	for i := uint64(1); i <= 30; i++ {
+		raw, _ := node.Block(i)
+		receipts := node.Receipts(i)
+		if err := raw.VerifyReceipts(receipts); err != nil {
+			t.Fatalf("TestTxsReceipts block %d: %v", i, err)
+		}
+		for j, tx := range raw.Transactions {
+			r := receipts[j]
+			if r.TransactionHash != tx.Hash || r.From != tx.From || r.To != tx.To {
+				t.Errorf("TestTxsReceipts %s receipt = %s from %s to %s; want its transaction's", tx.Hash, r.TransactionHash, r.From, r.To)
+			}
+			gas := util.DecodeHex(r.GasUsed)
+			switch tx.To {
+			case erc20:
+				kinds["erc20"]++
+				// transfer(to, amount) logs Transfer(from, to, amount)
+				if len(r.Logs) != 1 || gas != erc20Gas || !strings.HasPrefix(tx.Input, transferSelector) {
+					t.Fatalf("TestTxsReceipts %s = %d logs, %d gas, input %s; want an erc20 transfer", tx.Hash, len(r.Logs), gas, tx.Input)
+				}
+				l, to, amount := r.Logs[0], tx.Input[10:74], tx.Input[74:]
+				if l.Address != erc20 || l.Topics[0] != transferTopic || l.Topics[1] != "0x"+word(tx.From) || l.Topics[2] != "0x"+to || l.Data != "0x"+amount {
+					t.Errorf("TestTxsReceipts %s log = %+v; want Transfer(%s, %s, %s)", tx.Hash, l, tx.From, to, amount)
+				}
+			case erc721:
+				if len(r.Logs) != 1 || gas != erc721Gas || len(r.Logs[0].Topics) != 4 {
+					t.Fatalf("TestTxsReceipts %s = %d logs, %d gas; want an erc721 transfer", tx.Hash, len(r.Logs), gas)
+				}
+				l := r.Logs[0]
+				if l.Address != erc721 || l.Topics[0] != transferTopic {
+					t.Errorf("TestTxsReceipts %s log = %+v; want Transfer on %s", tx.Hash, l, erc721)
+				}
+				switch {
+				case strings.HasPrefix(tx.Input, mintSelector):
+					// mint(to) logs Transfer(0x0, to, id)
+					kinds["mint"]++
+					if l.Topics[1] != "0x"+word(zeroAddress) || l.Topics[2] != "0x"+tx.Input[10:74] {
+						t.Errorf("TestTxsReceipts %s log = %+v; want a mint to %s", tx.Hash, l, tx.Input[10:74])
+					}
+				case strings.HasPrefix(tx.Input, transferFromSelector):
+					// transferFrom(owner, to, id) logs Transfer(owner, to, id)
+					kinds["transferFrom"]++
+					if l.Topics[1] != "0x"+tx.Input[10:74] || l.Topics[2] != "0x"+tx.Input[74:138] || l.Topics[3] != "0x"+tx.Input[138:] {
+						t.Errorf("TestTxsReceipts %s log = %+v; want Transfer of input %s", tx.Hash, l, tx.Input)
+					}
+				default:
+					t.Errorf("TestTxsReceipts %s input = %s; want a mint or transferFrom", tx.Hash, tx.Input)
+				}
+			default:
+				kinds["ether"]++
+				if len(r.Logs) != 0 || gas != etherGas || tx.Input != "0x" {
+					t.Errorf("TestTxsReceipts %s = %d logs, %d gas, input %s; want an ether transfer", tx.Hash, len(r.Logs), gas, tx.Input)
+				}
+			}
+		}
+	}
+	for _, kind := range []string{"ether", "erc20", "mint", "transferFrom"} {
+		if kinds[kind] == 0 {
+			t.Errorf("TestTxsReceipts %s transactions = 0; want some", kind)
+		}
+	}
+}
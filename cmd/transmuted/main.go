@@ -17,8 +17,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/iquidus/blockspider/common"
 	"github.com/iquidus/blockspider/disk"
-	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/internal/sinks"
 	"github.com/iquidus/blockspider/params"
+	"github.com/iquidus/blockspider/sink"
 )
 
 var (
@@ -71,68 +72,7 @@ func isValidSignatureForStringBody(body []byte, signature string, signingKey []b
 	return digest == signature
 }
 
-func includes(addresses []string, a string) bool {
-	for _, addr := range addresses {
-		if addr == a {
-			return true
-		}
-	}
-
-	return false
-}
-
-// filterLogs creates a slice of logs matching the given criteria.
-func filterLogs(logs []common.Log, addresses []string, topics []string) []common.Log {
-	var ret []common.Log
-Logs:
-	for _, log := range logs {
-		if len(addresses) > 0 && !includes(addresses, log.Address) {
-			continue
-		}
-		// If the to filtered topics is greater than the amount of topics in logs, skip.
-		if len(topics) > len(log.Topics) {
-			continue Logs
-		}
-		for i, sub := range topics {
-			match := len(sub) == 0 // empty rule set == wildcard
-			for _, topic := range sub {
-				if log.Topics[i] == string(topic) {
-					match = true
-					break
-				}
-			}
-			if !match {
-				continue Logs
-			}
-		}
-		ret = append(ret, log)
-	}
-	return ret
-}
-
-func sendBlockMessage(blockWriter *kafka.Writer, block *common.Block) error {
-	for _, ktopic := range *blockWriter.Params {
-		nb := block
-		filteredLogs := filterLogs(nb.Logs, ktopic.Addresses, ktopic.Topics)
-		nb.Logs = filteredLogs
-		var bp = kafka.Payload{
-			Status:  "ACCEPTED",
-			Block:   *nb,
-			Version: 1,
-		}
-		payload, err := json.Marshal(bp)
-		if err != nil {
-			return err
-		}
-		err = blockWriter.WriteMessages(context.Background(), payload, ktopic.Topic)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func setupRouter(blockWriter *kafka.Writer, cfg params.TransmuteConfig) *gin.Engine {
+func setupRouter(blockWriter sink.Sink, cfg params.TransmuteConfig) *gin.Engine {
 	r := gin.Default()
 	r.ForwardedByClientIP = true
 	r.SetTrustedProxies(cfg.TrustedProxies)
@@ -162,8 +102,8 @@ func setupRouter(blockWriter *kafka.Writer, cfg params.TransmuteConfig) *gin.Eng
 		// Handle block event
 		// convert to common block
 		block := event.Data.Block.Convert()
-		// send block to kafka
-		err = sendBlockMessage(blockWriter, &block)
+		// send block to sinks
+		err = blockWriter.Accept(context.Background(), &block)
 		if err != nil {
 			log.Info("failed to write messages", "err", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -189,9 +129,18 @@ func main() {
 		log.Error("Error: could read config file", "err", err)
 	}
 	// Create blockwriter
-	kw := kafka.NewWriter(cfg.Kafka.Broker, nil, 1)
+	store, err := sinks.OpenStorage(&cfg)
+	if err != nil {
+		log.Error("Error: could not open storage", "err", err)
+		os.Exit(1)
+	}
+	bw, err := sinks.New(&cfg, store)
+	if err != nil {
+		log.Error("Error: could not create block sink", "err", err)
+		os.Exit(1)
+	}
 	// Init gin router
-	r := setupRouter(kw, cfg.Transmute)
+	r := setupRouter(bw, cfg.Transmute)
 	// Listen and Server
 	r.Run(fmt.Sprintf(":%d", cfg.Transmute.Port))
 }
@@ -1,7 +1,9 @@
 package common
 
 import (
+	"context"
 	"errors"
+	"fmt"
 
 	"github.com/iquidus/blockspider/util"
 )
@@ -28,31 +30,53 @@ type RawBlock struct {
 	ReceiptsRoot     string           `bson:"receiptsRoot" json:"receiptsRoot"`
 	StateRoot        string           `bson:"stateRoot" json:"stateRoot"`
 	TransactionsRoot string           `bson:"transactionsRoot" json:"transactionsRoot"`
+
+	// set by nodes past the fork that added them, needed to verify the hash
+	WithdrawalsRoot       string `bson:"withdrawalsRoot" json:"withdrawalsRoot,omitempty"`
+	BlobGasUsed           string `bson:"blobGasUsed" json:"blobGasUsed,omitempty"`
+	ExcessBlobGas         string `bson:"excessBlobGas" json:"excessBlobGas,omitempty"`
+	ParentBeaconBlockRoot string `bson:"parentBeaconBlockRoot" json:"parentBeaconBlockRoot,omitempty"`
 }
 
-// TODO(iquidus): refactor this, separate out txn receipts without introducing any additional looping
+// TransactionHashes returns the hashes of the block's transactions, in order
+func (b *RawBlock) TransactionHashes() []string {
+	hashes := make([]string, len(b.Transactions))
+	for i, txn := range b.Transactions {
+		hashes[i] = txn.Hash
+	}
+	return hashes
+}
+
+// Convert is like ConvertContext with a background context
 func (b *RawBlock) Convert(rpcClient *RPCClient, receipts *[]RawTransactionReceipt) (Block, error) {
+	return b.ConvertContext(context.Background(), rpcClient, receipts)
+}
+
+// TODO(iquidus): refactor this, separate out txn receipts without introducing any additional looping
+func (b *RawBlock) ConvertContext(ctx context.Context, rpcClient *RPCClient, receipts *[]RawTransactionReceipt) (Block, error) {
 	// make sure we have either an rpc client or txn receipts
 	if receipts == nil && rpcClient == nil {
 		return Block{}, errors.New("cannot convert block without receipts or rpc client")
 	}
 
+	// fetch txn receipts in batches if they were not provided
+	if receipts == nil {
+		r, err := rpcClient.GetTransactionReceipts(ctx, b.TransactionHashes())
+		if err != nil {
+			return Block{}, err
+		}
+		receipts = &r
+	}
+	if len(*receipts) != len(b.Transactions) {
+		return Block{}, fmt.Errorf("receipt count mismatch: have %d, want %d", len(*receipts), len(b.Transactions))
+	}
+
 	baseFeePerGas := util.DecodeValueHex(b.BaseFeePerGas)
-	// handle getting logs and txn receipts here
+	// handle getting logs here
 	txns := make([]Transaction, len(b.Transactions))
 	var logs []Log
 	for i, txn := range b.Transactions {
-		var receipt RawTransactionReceipt
-		if receipts != nil {
-			receipt = (*receipts)[i]
-		} else {
-			// get transaction receipts
-			r, err := rpcClient.GetTransactionReceipt(txn.Hash)
-			if err != nil {
-				return Block{}, err
-			}
-			receipt = *r
-		}
+		receipt := (*receipts)[i]
 
 		// convert raw txn to txn
 		txns[i] = txn.Convert(receipt)
@@ -0,0 +1,36 @@
+package common
+
+func includes(addresses []string, a string) bool {
+	for _, addr := range addresses {
+		if addr == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterLogs creates a slice of logs matching the given criteria. Each
+// non-empty topic must equal the log's topic at the same position, an empty
+// topic matches any.
+func FilterLogs(logs []Log, addresses []string, topics []string) []Log {
+	var ret []Log
+Logs:
+	for _, log := range logs {
+		if len(addresses) > 0 && !includes(addresses, log.Address) {
+			continue
+		}
+		// If the to filtered topics is greater than the amount of topics in logs, skip.
+		if len(topics) > len(log.Topics) {
+			continue Logs
+		}
+		for i, topic := range topics {
+			// empty topic == wildcard
+			if len(topic) > 0 && log.Topics[i] != topic {
+				continue Logs
+			}
+		}
+		ret = append(ret, log)
+	}
+	return ret
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilterLogs(t *testing.T) {
+	transfer := "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	approval := "0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925"
+	from := "0x000000000000000000000000a40da90ddd68f88ee0931864c1c646649da415c3"
+	logs := []Log{
+		{Address: "0xa", Topics: []string{transfer, from}},
+		{Address: "0xa", Topics: []string{approval, from}},
+		{Address: "0xb", Topics: []string{transfer}},
+	}
+
+	var tests = []struct {
+		addresses []string
+		topics    []string
+		want      int
+	}{
+		{nil, nil, 3},
+		{[]string{"0xa"}, nil, 2},
+		{[]string{"0xc"}, nil, 0},
+		{nil, []string{transfer}, 2},
+		{[]string{"0xa"}, []string{transfer}, 1},
+		{nil, []string{"", from}, 2},
+		{nil, []string{transfer, from}, 1},
+	}
+
+	for i, tt := range tests {
+		got := len(FilterLogs(logs, tt.addresses, tt.topics))
+		if got != tt.want {
+			t.Errorf("TestFilterLogs[%d] count = %d; want %d", i, got, tt.want)
+		}
+	}
+}
+
+// topics are compared whole and by position, not by the characters of the
+// filter topic
+func TestFilterLogsExact(t *testing.T) {
+	logs := []Log{
+		{Address: "0xa", Topics: []string{"a"}},
+		{Address: "0xb", Topics: []string{"abc", "def"}},
+	}
+
+	var tests = []struct {
+		topics []string
+		want   string // addresses of the matching logs
+	}{
+		{[]string{"abc"}, "[0xb]"},
+		{[]string{"a"}, "[0xa]"},
+		{[]string{"ab"}, "[]"},
+		{[]string{"def"}, "[]"},
+		{[]string{"", "def"}, "[0xb]"},
+		{[]string{"", "abc"}, "[]"},
+	}
+
+	for i, tt := range tests {
+		var got []string
+		for _, log := range FilterLogs(logs, nil, tt.topics) {
+			got = append(got, log.Address)
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("TestFilterLogsExact[%d] = %v; want %s", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// RateLimitConfig limits the requests sent to a node, e.g: to stay within a
+// hosted provider's plan
+type RateLimitConfig struct {
+	Rate        float64            `json:"rate"`        // request units per second (0 = unlimited)
+	Burst       float64            `json:"burst"`       // max units sent at once (0 = rate)
+	Costs       map[string]float64 `json:"costs"`       // units per method (default 1)
+	Concurrency int                `json:"concurrency"` // max requests in flight (0 = unlimited)
+}
+
+const (
+	minRateFactor  = 0.1  // throttling never lowers the rate below this share of the configured rate
+	recoverFactor  = 0.05 // share of the configured rate regained by each call that isn't throttled
+	throttleFactor = 0.5  // the rate is multiplied by this when throttled
+)
+
+// limiter is a token bucket of request units. Its rate is halved each time
+// the node throttles and regained gradually as calls succeed, and requests
+// are held back while the node's Retry-After has not elapsed.
+type limiter struct {
+	max   float64 // configured rate, 0 if unlimited
+	burst float64
+	costs map[string]float64
+	slots chan struct{} // nil if concurrency is unlimited
+
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	until  time.Time // Retry-After
+}
+
+func newLimiter(cfg *RateLimitConfig) *limiter {
+	l := &limiter{
+		max:    cfg.Rate,
+		burst:  cfg.Burst,
+		costs:  cfg.Costs,
+		rate:   cfg.Rate,
+		last:   time.Now(),
+		tokens: cfg.Burst,
+	}
+	if l.burst <= 0 {
+		l.burst = cfg.Rate
+		l.tokens = cfg.Rate
+	}
+	if cfg.Concurrency > 0 {
+		l.slots = make(chan struct{}, cfg.Concurrency)
+	}
+	return l
+}
+
+// cost returns the units of a call to method
+func (l *limiter) cost(method string) float64 {
+	if c, ok := l.costs[method]; ok {
+		return c
+	}
+	return 1
+}
+
+// batchCost returns the units of a batch, the sum of its calls
+func (l *limiter) batchCost(batch []rpc.BatchElem) float64 {
+	var cost float64
+	for _, elem := range batch {
+		cost += l.cost(elem.Method)
+	}
+	return cost
+}
+
+// acquire waits until cost units are available and a request slot is free.
+// release must be called once the request completes.
+func (l *limiter) acquire(ctx context.Context, cost float64) (release func(), err error) {
+	if err = l.wait(ctx, cost); err != nil {
+		return nil, err
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reserves cost units, then sleeps until the bucket has refilled them
+func (l *limiter) wait(ctx context.Context, cost float64) error {
+	l.mu.Lock()
+	now := time.Now()
+	var delay time.Duration
+	if l.max > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		l.tokens -= cost
+		if l.tokens < 0 {
+			delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+	}
+	if pause := l.until.Sub(now); pause > delay {
+		delay = pause
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += cost
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// observe adapts the rate to a call's outcome
+func (l *limiter) observe(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 {
+		return
+	}
+	if errors.Is(err, ErrRateLimited) {
+		l.rate *= throttleFactor
+		if floor := l.max * minRateFactor; l.rate < floor {
+			l.rate = floor
+		}
+		log.Warn("rpc node throttled, lowering rate", "rate", l.rate)
+		return
+	}
+	if l.rate < l.max {
+		l.rate += l.max * recoverFactor
+		if l.rate > l.max {
+			l.rate = l.max
+		}
+	}
+}
+
+// pause holds back requests for d
+func (l *limiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.until) {
+		l.until = until
+	}
+}
+
+// throttleTransport pauses the limiter for the Retry-After of throttled
+// http responses
+type throttleTransport struct {
+	base    http.RoundTripper
+	limiter *limiter
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			log.Warn("rpc node throttled", "retryAfter", d)
+			t.limiter.pause(d)
+		}
+	}
+	return resp, err
+}
+
+// parses a Retry-After header, in seconds or as an http date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
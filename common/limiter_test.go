@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(&RateLimitConfig{Rate: 100, Burst: 1, Costs: map[string]float64{"eth_getLogs": 5}})
+	ctx := context.Background()
+
+	// 1 unit of burst, then 10 units at 100/s
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		release, err := l.acquire(ctx, l.cost("eth_getLogs"))
+		if err != nil {
+			t.Fatal("Error acquiring limiter: ", err)
+		}
+		release()
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("TestLimiterRate elapsed = %v; want >= 100ms", d)
+	}
+
+	batch := []rpc.BatchElem{{Method: "eth_getLogs"}, {Method: "eth_getTransactionReceipt"}}
+	if c := l.batchCost(batch); c != 6 {
+		t.Errorf("TestLimiterRate batch cost = %v; want 6", c)
+	}
+}
+
+func TestLimiterAdapt(t *testing.T) {
+	l := newLimiter(&RateLimitConfig{Rate: 100})
+	l.observe(ErrRateLimited)
+	if l.rate != 50 {
+		t.Errorf("TestLimiterAdapt rate = %v; want 50", l.rate)
+	}
+	for i := 0; i < 10; i++ {
+		l.observe(ErrRateLimited)
+	}
+	if l.rate != 10 {
+		t.Errorf("TestLimiterAdapt floor = %v; want 10", l.rate)
+	}
+	for i := 0; i < 100; i++ {
+		l.observe(nil)
+	}
+	if l.rate != 100 {
+		t.Errorf("TestLimiterAdapt recovered = %v; want 100", l.rate)
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := newLimiter(&RateLimitConfig{Concurrency: 1})
+	release, err := l.acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatal("Error acquiring limiter: ", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = l.acquire(ctx, 1); err == nil {
+		t.Error("TestLimiterConcurrency second acquire err = nil; want deadline exceeded")
+	}
+	release()
+	if release, err = l.acquire(context.Background(), 1); err != nil {
+		t.Error("TestLimiterConcurrency acquire after release err = ", err)
+	}
+	release()
+}
+
+func TestRetryAfter(t *testing.T) {
+	// http dates have second precision
+	now := time.Now().Truncate(time.Second)
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"2", 2 * time.Second, true},
+		{now.Add(3 * time.Second).UTC().Format(http.TimeFormat), 3 * time.Second, true},
+		{"soon", 0, false},
+	} {
+		d, ok := retryAfter(c.value, now)
+		if ok != c.ok || d.Round(time.Second) != c.want {
+			t.Errorf("TestRetryAfter(%q) = %v, %v; want %v, %v", c.value, d, ok, c.want, c.ok)
+		}
+	}
+
+	// calls wait for the node's Retry-After
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &testChainService{10, "0xa"}); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, Retry: fastRetry})
+
+	start := time.Now()
+	head, err := client.LatestBlockNumber(context.Background())
+	if err != nil || head != 10 {
+		t.Errorf("TestRetryAfter head = %d, %v; want 10", head, err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("TestRetryAfter elapsed = %v; want >= 1s", d)
+	}
+}
@@ -0,0 +1,279 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/iquidus/blockspider/metrics"
+	"github.com/iquidus/blockspider/util"
+)
+
+const (
+	maxNodeFailures = 3                // consecutive failures before a node is unhealthy
+	nodeCooldown    = 30 * time.Second // before an unhealthy node is tried first again
+	latencyWeight   = 0.2              // weight of each new sample in a node's latency
+)
+
+// ErrNoQuorum is returned when fewer than RPCConfig.Quorum nodes agree on a
+// block hash or have reached a head
+var ErrNoQuorum = errors.New("rpc nodes did not reach quorum")
+
+// NodeHealth is a snapshot of a pooled node's health
+type NodeHealth struct {
+	Index    int           `json:"index"` // position in the rpc config, 0 is the primary
+	Type     string        `json:"type"`
+	Healthy  bool          `json:"healthy"`
+	Head     uint64        `json:"head"`
+	Latency  time.Duration `json:"latency"`
+	Failures int           `json:"failures"` // consecutive
+}
+
+type rpcNode struct {
+	index   int
+	kind    string
+	client  *rpc.Client
+	limiter *limiter
+	timeout time.Duration // per call
+
+	mu       sync.Mutex
+	latency  time.Duration // moving average
+	failures int
+	failedAt time.Time
+	head     uint64
+}
+
+// observe records the outcome of a call started at start. json-rpc errors
+// are answers from a working node and calls aborted by ctx aren't the
+// node's fault, neither count as failures.
+func (n *rpcNode) observe(ctx context.Context, start time.Time, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err != nil && !isRPCError(err) {
+		n.failures++
+		n.failedAt = time.Now()
+		return
+	}
+	n.failures = 0
+	d := time.Since(start)
+	if n.latency == 0 {
+		n.latency = d
+	} else {
+		n.latency += time.Duration(latencyWeight * float64(d-n.latency))
+	}
+}
+
+// call makes a json-rpc call, recording its latency and outcome
+func (n *rpcNode) call(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	release, err := n.limiter.acquire(ctx, n.limiter.cost(method))
+	if err != nil {
+		return err
+	}
+	defer release()
+	callCtx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	start := time.Now()
+	err = classify(ctx, n.client.CallContext(callCtx, result, method, args...))
+	n.limiter.observe(err)
+	n.observe(ctx, start, err)
+	metrics.ObserveRPC(method, start, err)
+	return err
+}
+
+// batchCall sends a json-rpc batch, recording its latency and outcome under
+// the method of the first element
+func (n *rpcNode) batchCall(ctx context.Context, batch []rpc.BatchElem) error {
+	release, err := n.limiter.acquire(ctx, n.limiter.batchCost(batch))
+	if err != nil {
+		return err
+	}
+	defer release()
+	callCtx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	start := time.Now()
+	err = classify(ctx, n.client.BatchCallContext(callCtx, batch))
+	// providers can throttle single elements, retry the batch if they do
+	for i := 0; err == nil && i < len(batch); i++ {
+		batch[i].Error = classify(ctx, batch[i].Error)
+		if errors.Is(batch[i].Error, ErrRateLimited) {
+			err = batch[i].Error
+		}
+	}
+	n.limiter.observe(err)
+	n.observe(ctx, start, err)
+	failed := err
+	for i := 0; failed == nil && i < len(batch); i++ {
+		failed = batch[i].Error
+	}
+	metrics.ObserveRPC(batch[0].Method, start, failed)
+	return err
+}
+
+func (n *rpcNode) setHead(head uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.head = head
+}
+
+func (n *rpcNode) health(now time.Time) NodeHealth {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return NodeHealth{
+		Index:    n.index,
+		Type:     n.kind,
+		Healthy:  n.failures < maxNodeFailures || now.Sub(n.failedAt) >= nodeCooldown,
+		Head:     n.head,
+		Latency:  n.latency,
+		Failures: n.failures,
+	}
+}
+
+func isRPCError(err error) bool {
+	var rpcErr rpc.Error
+	return errors.As(err, &rpcErr)
+}
+
+// Nodes returns the health of each pooled node, in config order
+func (r *RPCClient) Nodes() []NodeHealth {
+	now := time.Now()
+	health := make([]NodeHealth, len(r.nodes))
+	for i, n := range r.nodes {
+		health[i] = n.health(now)
+	}
+	return health
+}
+
+// ranked returns the nodes best first: healthy nodes before unhealthy ones,
+// then the highest head, then the lowest latency
+func (r *RPCClient) ranked() []*rpcNode {
+	health := r.Nodes()
+	nodes := make([]*rpcNode, len(r.nodes))
+	copy(nodes, r.nodes)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := health[nodes[i].index], health[nodes[j].index]
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		if a.Head != b.Head {
+			return a.Head > b.Head
+		}
+		return a.Latency < b.Latency
+	})
+	return nodes
+}
+
+// try runs fn against each node, best first, until one answers. Retryable
+// errors, missing and invalid blocks fail over to the next node, once every node has
+// failed the call is retried per the retry policy, unless the block is
+// missing on all of them. Permanent errors are returned as is.
+func (r *RPCClient) try(ctx context.Context, method string, fn func(n *rpcNode) error) error {
+	return r.retry.do(ctx, method, func() error {
+		var err error
+		for _, n := range r.ranked() {
+			err = fn(n)
+			if errors.Is(err, ErrBlockNotFound) && ctx.Err() == nil {
+				// another node may be further ahead
+				continue
+			}
+			if errors.Is(err, ErrInvalidBlock) && ctx.Err() == nil {
+				log.Warn("rpc node served an invalid block", "node", n.index, "method", method, "err", err)
+				continue
+			}
+			if !IsRetryable(err) || ctx.Err() != nil {
+				return err
+			}
+			if len(r.nodes) > 1 {
+				log.Warn("rpc node failed", "node", n.index, "method", method, "err", err)
+			}
+		}
+		return err
+	})
+}
+
+// pollHeads fetches the head of every node concurrently and returns the
+// highest head reached by at least quorum nodes
+func (r *RPCClient) pollHeads(ctx context.Context) (uint64, error) {
+	var (
+		wg    sync.WaitGroup
+		heads = make([]uint64, len(r.nodes))
+		errs  = make([]error, len(r.nodes))
+	)
+	for i, n := range r.nodes {
+		wg.Add(1)
+		go func(i int, n *rpcNode) {
+			defer wg.Done()
+			var bn string
+			if errs[i] = n.call(ctx, &bn, "eth_blockNumber"); errs[i] == nil {
+				heads[i] = util.DecodeHex(bn)
+				n.setHead(heads[i])
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	var reached []uint64
+	for i, err := range errs {
+		if err == nil {
+			reached = append(reached, heads[i])
+		}
+	}
+	need := r.quorum
+	if need < 1 {
+		need = 1
+	}
+	if len(reached) < need {
+		if len(reached) == 0 {
+			return 0, errors.Join(errs...)
+		}
+		return 0, fmt.Errorf("%w: %d/%d nodes answered", ErrNoQuorum, len(reached), need)
+	}
+	sort.Slice(reached, func(i, j int) bool { return reached[i] > reached[j] })
+	return reached[need-1], nil
+}
+
+// agree checks that at least quorum nodes, including served, have the block
+// number with hash
+func (r *RPCClient) agree(ctx context.Context, served *rpcNode, number, hash string) error {
+	if r.quorum < 2 {
+		return nil
+	}
+	var (
+		wg     sync.WaitGroup
+		hashes = make([]string, len(r.nodes))
+	)
+	for i, n := range r.nodes {
+		if n == served {
+			hashes[i] = hash
+			continue
+		}
+		wg.Add(1)
+		go func(i int, n *rpcNode) {
+			defer wg.Done()
+			var header RawHeader
+			if err := n.call(ctx, &header, "eth_getBlockByNumber", number, false); err == nil {
+				hashes[i] = header.Hash
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	agreed := 0
+	for _, h := range hashes {
+		if h == hash {
+			agreed++
+		}
+	}
+	if agreed < r.quorum {
+		return fmt.Errorf("%w: block %s %s confirmed by %d/%d nodes", ErrNoQuorum, number, hash, agreed, r.quorum)
+	}
+	return nil
+}
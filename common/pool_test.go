@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/iquidus/blockspider/util"
+)
+
+// testChainService serves a chain of empty blocks up to head, hashing each
+// block with prefix so nodes can disagree
+type testChainService struct {
+	head   uint64
+	prefix string
+}
+
+func (s *testChainService) BlockNumber() string {
+	return util.EncodeUint64(s.head)
+}
+
+func (s *testChainService) GetBlockByNumber(number string, full bool) *RawBlock {
+	n := util.DecodeHex(number)
+	if n > s.head {
+		return nil
+	}
+	return &RawBlock{Number: number, Hash: s.prefix + strings.TrimPrefix(number, "0x")}
+}
+
+func (s *testChainService) ClientVersion() string {
+	return "reorgd/v0.0.1"
+}
+
+func serveTestChain(t *testing.T, head uint64, prefix string) *httptest.Server {
+	svc := &testChainService{head, prefix}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", svc); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	if err := server.RegisterName("web3", svc); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// a node that's down
+func deadEndpoint(t *testing.T) string {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	return ts.URL
+}
+
+func TestPoolFailover(t *testing.T) {
+	good := serveTestChain(t, 10, "0xa")
+	client := newTestClient(t, &RPCConfig{
+		Type:     "http",
+		Endpoint: deadEndpoint(t),
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: good.URL}},
+	})
+	ctx := context.Background()
+
+	for i := 0; i < maxNodeFailures; i++ {
+		if _, err := client.Ping(ctx); err != nil {
+			t.Fatal("TestPoolFailover ping err = ", err)
+		}
+	}
+	nodes := client.Nodes()
+	if nodes[0].Healthy || nodes[0].Failures != maxNodeFailures {
+		t.Errorf("TestPoolFailover primary = %+v; want unhealthy", nodes[0])
+	}
+	if !nodes[1].Healthy {
+		t.Errorf("TestPoolFailover fallback = %+v; want healthy", nodes[1])
+	}
+
+	// unhealthy nodes are tried last
+	if ranked := client.ranked(); ranked[0].index != 1 {
+		t.Errorf("TestPoolFailover ranked first = %d; want 1", ranked[0].index)
+	}
+	block, err := client.GetBlockByHeight(ctx, 5)
+	if err != nil {
+		t.Fatal("TestPoolFailover get block err = ", err)
+	}
+	if block.Hash != "0xa5" {
+		t.Errorf("TestPoolFailover hash = %s; want 0xa5", block.Hash)
+	}
+}
+
+func TestPoolQuorumHead(t *testing.T) {
+	a := serveTestChain(t, 10, "0xa")
+	b := serveTestChain(t, 12, "0xa")
+	c := serveTestChain(t, 15, "0xa")
+	cfg := &RPCConfig{
+		Type:     "http",
+		Endpoint: a.URL,
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: b.URL}, {Type: "http", Endpoint: c.URL}},
+	}
+	ctx := context.Background()
+
+	head, err := newTestClient(t, cfg).LatestBlockNumber(ctx)
+	if err != nil || head != 15 {
+		t.Errorf("TestPoolQuorumHead head = %d, %v; want 15", head, err)
+	}
+
+	// the highest head reached by 2 nodes
+	cfg.Quorum = 2
+	client := newTestClient(t, cfg)
+	head, err = client.LatestBlockNumber(ctx)
+	if err != nil || head != 12 {
+		t.Errorf("TestPoolQuorumHead quorum head = %d, %v; want 12", head, err)
+	}
+	// the best node is the one with the highest head
+	if ranked := client.ranked(); ranked[0].index != 2 {
+		t.Errorf("TestPoolQuorumHead ranked first = %d; want 2", ranked[0].index)
+	}
+}
+
+func TestPoolQuorumBlock(t *testing.T) {
+	a := serveTestChain(t, 10, "0xa")
+	b := serveTestChain(t, 10, "0xa")
+	liar := serveTestChain(t, 10, "0xbad")
+	ctx := context.Background()
+
+	client := newTestClient(t, &RPCConfig{
+		Type:     "http",
+		Endpoint: liar.URL,
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: a.URL}, {Type: "http", Endpoint: b.URL}},
+		Quorum:   2,
+	})
+	if _, err := client.GetBlockByHeight(ctx, 5); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("TestPoolQuorumBlock liar err = %v; want %v", err, ErrNoQuorum)
+	}
+
+	client = newTestClient(t, &RPCConfig{
+		Type:     "http",
+		Endpoint: a.URL,
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: liar.URL}, {Type: "http", Endpoint: b.URL}},
+		Quorum:   2,
+	})
+	block, err := client.GetBlockByHeight(ctx, 5)
+	if err != nil || block.Hash != "0xa5" {
+		t.Errorf("TestPoolQuorumBlock block = %s, %v; want 0xa5", block.Hash, err)
+	}
+
+	// quorum can't exceed the pool
+	_, err = NewRPCClient(&RPCConfig{Type: "http", Endpoint: a.URL, Quorum: 2})
+	if err == nil {
+		t.Error("TestPoolQuorumBlock quorum 2 of 1 err = nil; want error")
+	}
+}
+
+func TestPoolBlockNotFound(t *testing.T) {
+	lagging := serveTestChain(t, 5, "0xa")
+	synced := serveTestChain(t, 10, "0xa")
+	ctx := context.Background()
+
+	// a node without the block fails over to one that has it
+	client := newTestClient(t, &RPCConfig{
+		Type:     "http",
+		Endpoint: lagging.URL,
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: synced.URL}},
+		Retry:    fastRetry,
+	})
+	block, err := client.GetBlockByHeight(ctx, 8)
+	if err != nil || block.Hash != "0xa8" {
+		t.Errorf("TestPoolBlockNotFound block = %s, %v; want 0xa8", block.Hash, err)
+	}
+
+	// missing on every node, not retried
+	var requests int64
+	ts := serveFlaky(t, &testChainService{5, "0xa"}, http.StatusOK, 0, &requests)
+	client = newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, Retry: fastRetry})
+	_, err = client.GetBlockByHeight(ctx, 8)
+	if !errors.Is(err, ErrBlockNotFound) || IsRetryable(err) {
+		t.Errorf("TestPoolBlockNotFound err = %v; want %v", err, ErrBlockNotFound)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("TestPoolBlockNotFound requests = %d; want 1", n)
+	}
+}
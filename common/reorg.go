@@ -0,0 +1,31 @@
+package common
+
+// BlockRef identifies a block
+type BlockRef struct {
+	Number uint64 `bson:"number" json:"number"`
+	Hash   string `bson:"hash" json:"hash"`
+}
+
+// Reorg describes a chain reorganisation: the blocks after Ancestor were
+// replaced by those in Added
+type Reorg struct {
+	Ancestor BlockRef `bson:"ancestor" json:"ancestor"` // common ancestor, the last block kept
+	Dropped  []string `bson:"dropped" json:"dropped"`   // hashes of the blocks removed, lowest first
+	Added    []string `bson:"added" json:"added"`       // hashes of the blocks that replaced them, lowest first
+	Depth    int      `bson:"depth" json:"depth"`       // number of blocks replaced
+	Time     int64    `bson:"time" json:"time"`         // unix time the reorg was handled
+
+	// the fork was deeper than the crawler's cache. Ancestor is the node's
+	// block below the cache, it and older blocks were not checked and may
+	// also have been replaced.
+	Deep bool `bson:"deep" json:"deep,omitempty"`
+}
+
+// Head returns the hash of the new head, or the ancestor's if no blocks were
+// added
+func (r *Reorg) Head() string {
+	if len(r.Added) == 0 {
+		return r.Ancestor.Hash
+	}
+	return r.Added[len(r.Added)-1]
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/iquidus/blockspider/metrics"
+)
+
+// RetryConfig controls how failed rpc calls are retried
+type RetryConfig struct {
+	Attempts   int    `json:"attempts"`   // max attempts per call, including the first (0 = DefaultRetryAttempts)
+	MinBackoff string `json:"minBackoff"` // delay before the first retry (default DefaultMinBackoff)
+	MaxBackoff string `json:"maxBackoff"` // max delay between retries (default DefaultMaxBackoff)
+	Timeout    string `json:"timeout"`    // per attempt timeout (default DefaultCallTimeout)
+}
+
+const (
+	DefaultRetryAttempts = 5
+	DefaultMinBackoff    = "250ms"
+	DefaultMaxBackoff    = "10s"
+	DefaultCallTimeout   = "30s"
+)
+
+// json-rpc error code used by node providers when a request limit is exceeded
+const limitExceededCode = -32005
+
+var (
+	// ErrBlockNotFound is returned when the node doesn't have a block
+	ErrBlockNotFound = errors.New("block not found")
+	// ErrRateLimited is returned when the node throttles requests
+	ErrRateLimited = errors.New("rpc rate limited")
+	// ErrTimeout is returned when a call exceeds RetryConfig.Timeout
+	ErrTimeout = errors.New("rpc timeout")
+)
+
+type retryPolicy struct {
+	attempts   int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+}
+
+func newRetryPolicy(cfg *RetryConfig) (*retryPolicy, error) {
+	p := &retryPolicy{attempts: cfg.Attempts}
+	if p.attempts <= 0 {
+		p.attempts = DefaultRetryAttempts
+	}
+	durations := []struct {
+		value string
+		def   string
+		d     *time.Duration
+	}{
+		{cfg.MinBackoff, DefaultMinBackoff, &p.minBackoff},
+		{cfg.MaxBackoff, DefaultMaxBackoff, &p.maxBackoff},
+		{cfg.Timeout, DefaultCallTimeout, &p.timeout},
+	}
+	for _, v := range durations {
+		if v.value == "" {
+			v.value = v.def
+		}
+		d, err := time.ParseDuration(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rpc retry config: %w", err)
+		}
+		*v.d = d
+	}
+	return p, nil
+}
+
+// backoff returns the delay before retry n (from 0): exponential up to
+// maxBackoff, with jitter so concurrent callers don't retry in step
+func (p *retryPolicy) backoff(n int) time.Duration {
+	d := p.minBackoff << n
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do calls fn until it succeeds, fails with an error that isn't retryable,
+// ctx is done or the attempts run out, returning the last error
+func (p *retryPolicy) do(ctx context.Context, method string, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt < p.attempts && IsRetryable(err) && ctx.Err() == nil; attempt++ {
+		delay := p.backoff(attempt - 1)
+		log.Debug("retrying rpc call", "method", method, "attempt", attempt+1, "in", delay, "err", err)
+		metrics.RPCRetries.WithLabelValues(method).Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = fn()
+	}
+	return err
+}
+
+// classify wraps transient call errors with ErrRateLimited or ErrTimeout.
+// ctx is the caller's context, errors after it's done are returned as is.
+func classify(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	var (
+		httpErr rpc.HTTPError
+		rpcErr  rpc.Error
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests,
+		errors.As(err, &rpcErr) && rpcErr.ErrorCode() == limitExceededCode:
+		return fmt.Errorf("%w: %w", ErrRateLimited, err)
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// IsRetryable reports whether a call that failed with err may succeed if
+// retried: transport errors, rate limits and timeouts. Missing blocks,
+// invalid blocks and other json-rpc errors are answers from the node and are
+// permanent.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrBlockNotFound) || errors.Is(err, ErrInvalidBlock) {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrTimeout) {
+		return true
+	}
+	return !isRPCError(err)
+}
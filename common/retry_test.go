@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var fastRetry = RetryConfig{MinBackoff: "1ms", MaxBackoff: "5ms", Timeout: "1s"}
+
+// serves svc, answering the first failures requests with status
+func serveFlaky(t *testing.T, svc interface{}, status int, failures int64, requests *int64) *httptest.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", svc); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(requests, 1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestRetry(t *testing.T) {
+	var requests int64
+	ts := serveFlaky(t, &testChainService{10, "0xa"}, http.StatusServiceUnavailable, 2, &requests)
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, Retry: fastRetry})
+
+	head, err := client.LatestBlockNumber(context.Background())
+	if err != nil || head != 10 {
+		t.Errorf("TestRetry head = %d, %v; want 10", head, err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("TestRetry requests = %d; want 3", n)
+	}
+
+	// attempts run out
+	var limited int64
+	ts = serveFlaky(t, &testChainService{10, "0xa"}, http.StatusTooManyRequests, 100, &limited)
+	cfg := fastRetry
+	cfg.Attempts = 3
+	client = newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, Retry: cfg})
+	_, err = client.GetBlockByHeight(context.Background(), 1)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("TestRetry err = %v; want %v", err, ErrRateLimited)
+	}
+	if n := atomic.LoadInt64(&limited); n != 3 {
+		t.Errorf("TestRetry rate limited requests = %d; want 3", n)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	var requests int64
+	ts := serveFlaky(t, &testChainService{10, "0xa"}, http.StatusOK, 0, &requests)
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, Retry: fastRetry})
+
+	// json-rpc errors are answers, they aren't retried
+	_, err := client.GetBlockReceipts(context.Background(), "0x01")
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) || IsRetryable(err) {
+		t.Errorf("TestRetryPermanent err = %v; want permanent json-rpc error", err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("TestRetryPermanent requests = %d; want 1", n)
+	}
+}
+
+// slowService answers after delay
+type slowService struct {
+	delay time.Duration
+}
+
+func (s *slowService) BlockNumber(ctx context.Context) (string, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+	}
+	return "0x1", nil
+}
+
+func TestRetryTimeout(t *testing.T) {
+	var requests int64
+	ts := serveFlaky(t, &slowService{time.Second}, http.StatusOK, 0, &requests)
+	cfg := fastRetry
+	cfg.Attempts, cfg.Timeout = 2, "20ms"
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, Retry: cfg})
+
+	_, err := client.LatestBlockNumber(context.Background())
+	if !errors.Is(err, ErrTimeout) || !IsRetryable(err) {
+		t.Errorf("TestRetryTimeout err = %v; want %v", err, ErrTimeout)
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("TestRetryTimeout requests = %d; want 2", n)
+	}
+
+	// the caller's context isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = client.LatestBlockNumber(ctx); errors.Is(err, ErrTimeout) || IsRetryable(err) {
+		t.Errorf("TestRetryTimeout cancelled err = %v; want context.Canceled", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p, err := newRetryPolicy(&RetryConfig{MinBackoff: "100ms", MaxBackoff: "1s"})
+	if err != nil {
+		t.Fatal("Error creating retry policy: ", err)
+	}
+	if p.attempts != DefaultRetryAttempts {
+		t.Errorf("TestRetryBackoff attempts = %d; want %d", p.attempts, DefaultRetryAttempts)
+	}
+	for n, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		if d := p.backoff(n); d < want/2 || d > want {
+			t.Errorf("TestRetryBackoff backoff(%d) = %v; want %v-%v", n, d, want/2, want)
+		}
+	}
+	if _, err = newRetryPolicy(&RetryConfig{Timeout: "soon"}); err == nil {
+		t.Error("TestRetryBackoff invalid timeout err = nil; want error")
+	}
+}
@@ -2,27 +2,50 @@ package common
 
 import (
 	"context"
-	"os"
+	"errors"
+	"fmt"
+	"net/http"
 
-	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rpc"
 	homedir "github.com/mitchellh/go-homedir"
 
 	"github.com/iquidus/blockspider/util"
 )
 
+// default number of requests sent in a single json-rpc batch
+const DefaultBatchSize = 100
+
 type RPCConfig struct {
-	Type     string `json:"type"`
-	Endpoint string `json:"endpoint"`
+	Type      string `json:"type"`
+	Endpoint  string `json:"endpoint"`
+	BatchSize int    `json:"batchSize"` // max requests per batch call (0 = DefaultBatchSize)
+
+	Nodes  []RPCConfig `json:"nodes"`  // fallback endpoints pooled with this one
+	Quorum int         `json:"quorum"` // nodes that must agree on each block hash (0 = disabled)
+	Retry  RetryConfig `json:"retry"`
+
+	RateLimit RateLimitConfig `json:"rateLimit"` // for this endpoint only, pooled nodes set their own
+
+	// recompute each block's hash, transactions and receipts roots, failing
+	// over to the next node when they don't match
+	Verify bool `json:"verify"`
 }
 
+// json-rpc error code returned when a method is not available
+const methodNotFoundCode = -32601
+
+// RPCClient makes json-rpc calls against a pool of nodes, failing over to
+// the next healthiest node when one is unreachable
 type RPCClient struct {
-	client *rpc.Client
-	eth    *ethclient.Client
+	nodes         []*rpcNode
+	quorum        int
+	retry         *retryPolicy
+	batchSize     int
+	blockReceipts bool // all nodes support eth_getBlockReceipts
+	verify        bool
 }
 
-func dialNewClient(cfg *RPCConfig) (*rpc.Client, error) {
+func dialNewClient(cfg *RPCConfig, limiter *limiter) (*rpc.Client, error) {
 	var (
 		client *rpc.Client
 		err    error
@@ -30,7 +53,8 @@ func dialNewClient(cfg *RPCConfig) (*rpc.Client, error) {
 
 	switch cfg.Type {
 	case "http", "https":
-		if client, err = rpc.DialHTTP(cfg.Endpoint); err != nil {
+		httpClient := &http.Client{Transport: &throttleTransport{http.DefaultTransport, limiter}}
+		if client, err = rpc.DialOptions(context.Background(), cfg.Endpoint, rpc.WithHTTPClient(httpClient)); err != nil {
 			return nil, err
 		}
 	case "unix", "ipc":
@@ -54,62 +78,210 @@ func dialNewClient(cfg *RPCConfig) (*rpc.Client, error) {
 	return client, nil
 }
 
-func NewRPCClient(cfg *RPCConfig) *RPCClient {
-	client, err := dialNewClient(cfg)
+// NewRPCClient dials the endpoint in cfg and any pooled cfg.Nodes
+func NewRPCClient(cfg *RPCConfig) (*RPCClient, error) {
+	cfgs := append([]RPCConfig{*cfg}, cfg.Nodes...)
+	if cfg.Quorum > len(cfgs) {
+		return nil, fmt.Errorf("rpc quorum %d exceeds %d nodes", cfg.Quorum, len(cfgs))
+	}
+	retry, err := newRetryPolicy(&cfg.Retry)
 	if err != nil {
-		log.Error("could not dial rpc client", "err", err)
-		os.Exit(1)
+		return nil, err
+	}
+	nodes := make([]*rpcNode, len(cfgs))
+	for i := range cfgs {
+		limiter := newLimiter(&cfgs[i].RateLimit)
+		client, err := dialNewClient(&cfgs[i], limiter)
+		if err != nil {
+			for _, n := range nodes[:i] {
+				n.client.Close()
+			}
+			return nil, fmt.Errorf("could not dial rpc node %d: %w", i, err)
+		}
+		nodes[i] = &rpcNode{index: i, kind: cfgs[i].Type, client: client, limiter: limiter, timeout: retry.timeout}
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
 	}
-	eth := ethclient.NewClient(client)
-	rpcClient := &RPCClient{client, eth}
+	return &RPCClient{nodes: nodes, quorum: cfg.Quorum, retry: retry, batchSize: batchSize, verify: cfg.Verify}, nil
+}
 
-	return rpcClient
+// Close closes the connections to all nodes
+func (r *RPCClient) Close() {
+	for _, n := range r.nodes {
+		n.client.Close()
+	}
 }
 
-func (r *RPCClient) getBlockBy(method string, params ...interface{}) (RawBlock, error) {
-	var reply RawBlock
+// call makes a json-rpc call on the healthiest node that answers
+func (r *RPCClient) call(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	return r.try(ctx, method, func(n *rpcNode) error {
+		return n.call(ctx, result, method, args...)
+	})
+}
 
-	err := r.client.Call(&reply, method, params...)
+// getBlockBy fetches a block by number or hash, verifying it if it has full
+// transactions and verification is enabled
+func (r *RPCClient) getBlockBy(ctx context.Context, method string, id string, full bool) (RawBlock, error) {
+	var (
+		reply  RawBlock
+		served *rpcNode
+	)
+
+	err := r.try(ctx, method, func(n *rpcNode) error {
+		served = n
+		reply = RawBlock{}
+		if err := n.call(ctx, &reply, method, id, full); err != nil {
+			return err
+		}
+		// null result, e.g: a future block or a lagging node
+		if reply.Hash == "" {
+			return fmt.Errorf("%w: %s", ErrBlockNotFound, id)
+		}
+		if r.verify && full {
+			return reply.VerifyHeader()
+		}
+		return nil
+	})
 
 	if err != nil {
 		return RawBlock{}, err
 	}
 
+	if err = r.agree(ctx, served, reply.Number, reply.Hash); err != nil {
+		return RawBlock{}, err
+	}
+
 	return reply, nil
 }
 
-func (r *RPCClient) GetLatestBlock() (RawBlock, error) {
-	bn, err := r.LatestBlockNumber()
+func (r *RPCClient) GetLatestBlock(ctx context.Context) (RawBlock, error) {
+	bn, err := r.LatestBlockNumber(ctx)
 
 	if err != nil {
 		return RawBlock{}, err
 	}
 
-	return r.getBlockBy("eth_getBlockByNumber", util.EncodeUint64(bn))
+	return r.getBlockBy(ctx, "eth_getBlockByNumber", util.EncodeUint64(bn), false)
 }
 
-func (r *RPCClient) GetBlockByHeight(height uint64) (RawBlock, error) {
-	return r.getBlockBy("eth_getBlockByNumber", util.EncodeUint64(height), true)
+func (r *RPCClient) GetBlockByHeight(ctx context.Context, height uint64) (RawBlock, error) {
+	return r.getBlockBy(ctx, "eth_getBlockByNumber", util.EncodeUint64(height), true)
 }
 
-func (r *RPCClient) GetBlockByHash(hash string) (RawBlock, error) {
-	return r.getBlockBy("eth_getBlockByHash", hash, true)
+func (r *RPCClient) GetBlockByHash(ctx context.Context, hash string) (RawBlock, error) {
+	return r.getBlockBy(ctx, "eth_getBlockByHash", hash, true)
+}
+
+// ErrSubscriptionsUnsupported is returned by SubscribeNewHeads over http
+var ErrSubscriptionsUnsupported = rpc.ErrNotificationsUnsupported
+
+// RawHeader is the subset of a newHeads notification used to trigger syncs
+type RawHeader struct {
+	Hash       string `json:"hash"`
+	Number     string `json:"number"`
+	ParentHash string `json:"parentHash"`
 }
 
-func (r *RPCClient) LatestBlockNumber() (uint64, error) {
-	var bn string
+// Subscription is a json-rpc subscription
+type Subscription interface {
+	// Err receives an error if the subscription fails, e.g: the connection drops
+	Err() <-chan error
+	Unsubscribe()
+}
+
+// SubscribeNewHeads subscribes to new chain heads on the healthiest node
+// with a ws or ipc client
+func (r *RPCClient) SubscribeNewHeads(ctx context.Context, ch chan<- *RawHeader) (Subscription, error) {
+	var err error = ErrSubscriptionsUnsupported
+	for _, n := range r.ranked() {
+		sub, subErr := n.client.EthSubscribe(ctx, ch, "newHeads")
+		if subErr == nil {
+			return sub, nil
+		}
+		if !errors.Is(subErr, ErrSubscriptionsUnsupported) {
+			err = subErr
+		}
+	}
+	return nil, err
+}
+
+// GetBlockByTag returns the number and hash of a tagged block (e.g: "safe"
+// or "finalized")
+func (r *RPCClient) GetBlockByTag(ctx context.Context, tag string) (uint64, string, error) {
+	var header struct {
+		Number string `json:"number"`
+		Hash   string `json:"hash"`
+	}
+	err := r.call(ctx, &header, "eth_getBlockByNumber", tag, false)
+	if err != nil {
+		return 0, "", err
+	}
+	if header.Hash == "" {
+		return 0, "", fmt.Errorf("%w: %s", ErrBlockNotFound, tag)
+	}
+	return util.DecodeHex(header.Number), header.Hash, nil
+}
+
+// ConvertBlock converts a raw block to a Block, fetching all receipts from
+// one node, in a single call when the nodes support eth_getBlockReceipts.
+// With verification enabled, a node whose receipts don't match the receipts
+// root fails over to the next.
+func (r *RPCClient) ConvertBlock(ctx context.Context, raw *RawBlock) (Block, error) {
+	receipts := []RawTransactionReceipt{}
+	if len(raw.Transactions) == 0 {
+		if r.verify {
+			if err := raw.VerifyReceipts(receipts); err != nil {
+				return Block{}, err
+			}
+		}
+		return raw.Convert(nil, &receipts)
+	}
 
-	err := r.client.Call(&bn, "eth_blockNumber")
+	method := "eth_getTransactionReceipt"
+	if r.SupportsBlockReceipts() {
+		method = "eth_getBlockReceipts"
+	}
+	err := r.try(ctx, method, func(n *rpcNode) (err error) {
+		if r.SupportsBlockReceipts() {
+			receipts, err = n.blockReceipts(ctx, raw.Hash)
+		} else {
+			receipts, err = n.transactionReceipts(ctx, raw.TransactionHashes(), r.batchSize)
+		}
+		if err != nil {
+			return err
+		}
+		// a lagging node returns null or no receipts for a block it
+		// doesn't have yet
+		if len(receipts) != len(raw.Transactions) {
+			return fmt.Errorf("%w: receipts for %s", ErrBlockNotFound, raw.Hash)
+		}
+		if r.verify {
+			return raw.VerifyReceipts(receipts)
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, err
+		return Block{}, err
 	}
+	return raw.Convert(nil, &receipts)
+}
 
-	return util.DecodeHex(bn), nil
+// LatestBlockNumber polls every node's head and returns the highest head
+// reached by at least quorum nodes
+func (r *RPCClient) LatestBlockNumber(ctx context.Context) (uint64, error) {
+	var head uint64
+	err := r.retry.do(ctx, "eth_blockNumber", func() (err error) {
+		head, err = r.pollHeads(ctx)
+		return err
+	})
+	return head, err
 }
 
-func (r *RPCClient) GetLogs(address []string, hash string, topics []string) ([]RawLog, error) {
+func (r *RPCClient) GetLogs(ctx context.Context, address []string, hash string, topics []string) ([]RawLog, error) {
 	var logs []RawLog
-	err := r.client.Call(&logs, "eth_getLogs", &LogRequest{
+	err := r.call(ctx, &logs, "eth_getLogs", &LogRequest{
 		BlockHash: hash,
 		Address:   address,
 		Topics:    topics,
@@ -121,9 +293,9 @@ func (r *RPCClient) GetLogs(address []string, hash string, topics []string) ([]R
 	return logs, nil
 }
 
-func (r *RPCClient) GetTransactionReceipt(hash string) (*RawTransactionReceipt, error) {
+func (r *RPCClient) GetTransactionReceipt(ctx context.Context, hash string) (*RawTransactionReceipt, error) {
 	var receipt RawTransactionReceipt
-	err := r.client.Call(&receipt, "eth_getTransactionReceipt", hash)
+	err := r.call(ctx, &receipt, "eth_getTransactionReceipt", hash)
 	if err != nil {
 		return nil, err
 	}
@@ -131,10 +303,105 @@ func (r *RPCClient) GetTransactionReceipt(hash string) (*RawTransactionReceipt,
 	return &receipt, nil
 }
 
-func (r *RPCClient) Ping() (string, error) {
+// GetTransactionReceipts fetches the receipts for the given transaction hashes
+// using batched json-rpc calls. Receipts are returned in the same order as hashes.
+func (r *RPCClient) GetTransactionReceipts(ctx context.Context, hashes []string) ([]RawTransactionReceipt, error) {
+	var receipts []RawTransactionReceipt
+	err := r.try(ctx, "eth_getTransactionReceipt", func(n *rpcNode) (err error) {
+		receipts, err = n.transactionReceipts(ctx, hashes, r.batchSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
+
+// fetches receipts from n in batches of batchSize
+func (n *rpcNode) transactionReceipts(ctx context.Context, hashes []string, batchSize int) ([]RawTransactionReceipt, error) {
+	receipts := make([]RawTransactionReceipt, len(hashes))
+	for start := 0; start < len(hashes); start += batchSize {
+		end := start + batchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := make([]rpc.BatchElem, end-start)
+		for i := range batch {
+			batch[i] = rpc.BatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []interface{}{hashes[start+i]},
+				Result: &receipts[start+i],
+			}
+		}
+		if err := n.batchCall(ctx, batch); err != nil {
+			return nil, err
+		}
+		for i, elem := range batch {
+			if elem.Error != nil {
+				return nil, elem.Error
+			}
+			// a null result leaves the receipt empty
+			if receipts[start+i].TransactionHash == "" {
+				return nil, fmt.Errorf("%w: receipt for transaction %s", ErrBlockNotFound, hashes[start+i])
+			}
+		}
+	}
+
+	return receipts, nil
+}
+
+// GetBlockReceipts fetches all receipts for the given block hash in a single call
+func (r *RPCClient) GetBlockReceipts(ctx context.Context, hash string) ([]RawTransactionReceipt, error) {
+	var receipts []RawTransactionReceipt
+	err := r.try(ctx, "eth_getBlockReceipts", func(n *rpcNode) (err error) {
+		receipts, err = n.blockReceipts(ctx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
+
+func (n *rpcNode) blockReceipts(ctx context.Context, hash string) ([]RawTransactionReceipt, error) {
+	var receipts []RawTransactionReceipt
+	if err := n.call(ctx, &receipts, "eth_getBlockReceipts", hash); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// ProbeBlockReceipts checks whether every node supports eth_getBlockReceipts
+// and records the result for SupportsBlockReceipts.
+func (r *RPCClient) ProbeBlockReceipts(ctx context.Context) (bool, error) {
+	supported := true
+	for _, n := range r.nodes {
+		var receipts []RawTransactionReceipt
+		err := n.call(ctx, &receipts, "eth_getBlockReceipts", "latest")
+		if err != nil {
+			var rpcErr rpc.Error
+			if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == methodNotFoundCode {
+				supported = false
+				continue
+			}
+			return false, err
+		}
+	}
+	r.blockReceipts = supported
+	return supported, nil
+}
+
+// SupportsBlockReceipts returns the result of the last ProbeBlockReceipts call
+func (r *RPCClient) SupportsBlockReceipts() bool {
+	return r.blockReceipts
+}
+
+func (r *RPCClient) Ping(ctx context.Context) (string, error) {
 	var version string
 
-	err := r.client.Call(&version, "web3_clientVersion")
+	err := r.call(ctx, &version, "web3_clientVersion")
 	if err != nil {
 		return "", err
 	}
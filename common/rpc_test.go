@@ -0,0 +1,155 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/iquidus/blockspider/disk"
+)
+
+type testEthService struct {
+	receipts map[string]RawTransactionReceipt
+}
+
+func (s *testEthService) GetTransactionReceipt(hash string) (*RawTransactionReceipt, error) {
+	receipt, ok := s.receipts[hash]
+	if !ok {
+		return nil, nil
+	}
+	return &receipt, nil
+}
+
+// testBlockReceiptsService adds eth_getBlockReceipts to testEthService
+type testBlockReceiptsService struct {
+	testEthService
+	blockReceipts []RawTransactionReceipt
+}
+
+func (s *testBlockReceiptsService) GetBlockReceipts(blockNrOrHash string) ([]RawTransactionReceipt, error) {
+	return s.blockReceipts, nil
+}
+
+func newTestEthService(receipts []RawTransactionReceipt) *testEthService {
+	svc := &testEthService{receipts: make(map[string]RawTransactionReceipt)}
+	for _, r := range receipts {
+		svc.receipts[r.TransactionHash] = r
+	}
+	return svc
+}
+
+// starts a json-rpc server serving the test receipts, counting http requests
+func newTestServer(t *testing.T, receipts []RawTransactionReceipt, requests *int64) *httptest.Server {
+	return serveTestService(t, newTestEthService(receipts), requests)
+}
+
+func serveTestService(t *testing.T, svc interface{}, requests *int64) *httptest.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", svc); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestClient(t *testing.T, cfg *RPCConfig) *RPCClient {
+	client, err := NewRPCClient(cfg)
+	if err != nil {
+		t.Fatal("Error creating rpc client: ", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestConvertBatched(t *testing.T) {
+	var rawBlock RawBlock
+	err := disk.ReadJsonFile[RawBlock](blockPath, &rawBlock)
+	if err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	var receipts []RawTransactionReceipt
+	err = disk.ReadJsonFile[[]RawTransactionReceipt](receiptsPath, &receipts)
+	if err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+
+	var requests int64
+	ts := newTestServer(t, receipts, &requests)
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL, BatchSize: 100})
+
+	block, err := rawBlock.Convert(client, nil)
+	if err != nil {
+		t.Fatal("Error converting block: ", err)
+	}
+
+	// 273 receipts in batches of 100 should take 3 round trips
+	if requests != 3 {
+		t.Errorf("TestConvertBatched requests = %d; want 3", requests)
+	}
+	if block.TransactionCount != txns {
+		t.Errorf("TestConvertBatched txn count = %d; want %d", block.TransactionCount, txns)
+	}
+	lc := len(block.Logs)
+	if lc != logs {
+		t.Errorf("TestConvertBatched log count = %d; want %d", lc, logs)
+	}
+}
+
+func TestGetTransactionReceiptsMissing(t *testing.T) {
+	var requests int64
+	ts := newTestServer(t, nil, &requests)
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL})
+
+	_, err := client.GetTransactionReceipts(context.Background(), []string{"0x01"})
+	if err == nil {
+		t.Error("TestGetTransactionReceiptsMissing err = nil; want error")
+	}
+}
+
+func TestProbeBlockReceipts(t *testing.T) {
+	var receipts []RawTransactionReceipt
+	err := disk.ReadJsonFile[[]RawTransactionReceipt](receiptsPath, &receipts)
+	if err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+
+	// node without eth_getBlockReceipts
+	var requests int64
+	ts := newTestServer(t, receipts, &requests)
+	client := newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL})
+	ok, err := client.ProbeBlockReceipts(context.Background())
+	if err != nil {
+		t.Fatal("Error probing node: ", err)
+	}
+	if ok || client.SupportsBlockReceipts() {
+		t.Errorf("TestProbeBlockReceipts supported = %v; want false", ok)
+	}
+
+	// node with eth_getBlockReceipts
+	svc := &testBlockReceiptsService{*newTestEthService(receipts), receipts}
+	ts = serveTestService(t, svc, &requests)
+	client = newTestClient(t, &RPCConfig{Type: "http", Endpoint: ts.URL})
+	ok, err = client.ProbeBlockReceipts(context.Background())
+	if err != nil {
+		t.Fatal("Error probing node: ", err)
+	}
+	if !ok || !client.SupportsBlockReceipts() {
+		t.Errorf("TestProbeBlockReceipts supported = %v; want true", ok)
+	}
+
+	got, err := client.GetBlockReceipts(context.Background(), "0xb63606c02caa653d6561cf03bb11c526d7d61cfafb01a0c15245cb4b91b517f1")
+	if err != nil {
+		t.Fatal("Error getting block receipts: ", err)
+	}
+	if len(got) != txns {
+		t.Errorf("TestProbeBlockReceipts receipts = %d; want %d", len(got), txns)
+	}
+}
@@ -23,6 +23,17 @@ type RawTransaction struct {
 	V                    string `json:"v"`
 	R                    string `json:"r"`
 	S                    string `json:"s"`
+
+	// typed transaction fields, needed to verify the hash
+	YParity             string           `bson:"yParity" json:"yParity,omitempty"`
+	AccessList          []RawAccessTuple `bson:"accessList" json:"accessList,omitempty"`
+	MaxFeePerBlobGas    string           `bson:"maxFeePerBlobGas" json:"maxFeePerBlobGas,omitempty"`
+	BlobVersionedHashes []string         `bson:"blobVersionedHashes" json:"blobVersionedHashes,omitempty"`
+}
+
+type RawAccessTuple struct {
+	Address     string   `bson:"address" json:"address"`
+	StorageKeys []string `bson:"storageKeys" json:"storageKeys"`
 }
 
 type RawTransactionReceipt struct {
@@ -36,6 +47,7 @@ type RawTransactionReceipt struct {
 	Logs              []RawLog `bson:"logs" json:"logs"`
 	LogsBloom         string   `bson:"logsBloom" json:"logsBloom"`
 	Status            string   `bson:"status" json:"status"`
+	Root              string   `bson:"root" json:"root,omitempty"` // post-state root, before byzantium
 	To                string   `bson:"to" json:"to"`
 	TransactionHash   string   `bson:"transactionHash" json:"transactionHash"`
 	TransactionIndex  string   `bson:"transactionIndex" json:"transactionIndex"`
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+
+	"github.com/iquidus/blockspider/util"
+)
+
+// ErrInvalidBlock is returned when a block's hash or roots don't match its
+// contents
+var ErrInvalidBlock = errors.New("invalid block")
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidBlock, fmt.Sprintf(format, args...))
+}
+
+// VerifyHeader checks that the block hash matches the header, and that the
+// transactions root and each transaction hash match the transactions. The
+// block must have been fetched with full transactions.
+func (b *RawBlock) VerifyHeader() error {
+	header, err := b.header()
+	if err != nil {
+		return invalid("block %s: %v", b.Hash, err)
+	}
+	if hash := header.Hash().Hex(); hash != b.Hash {
+		return invalid("block %s: header hash is %s", b.Hash, hash)
+	}
+
+	txs := make(types.Transactions, len(b.Transactions))
+	for i := range b.Transactions {
+		if txs[i], err = b.Transactions[i].consensus(); err != nil {
+			return invalid("block %s: transaction %s: %v", b.Hash, b.Transactions[i].Hash, err)
+		}
+		if hash := txs[i].Hash().Hex(); hash != b.Transactions[i].Hash {
+			return invalid("block %s: transaction %s hash is %s", b.Hash, b.Transactions[i].Hash, hash)
+		}
+	}
+	if root := types.DeriveSha(txs, trie.NewStackTrie(nil)); root != header.TxHash {
+		return invalid("block %s: transactions root is %s", b.Hash, root.Hex())
+	}
+	return nil
+}
+
+// VerifyReceipts checks that the receipts root matches receipts
+func (b *RawBlock) VerifyReceipts(receipts []RawTransactionReceipt) error {
+	rs := make(types.Receipts, len(receipts))
+	for i := range receipts {
+		var err error
+		if rs[i], err = receipts[i].consensus(); err != nil {
+			return invalid("block %s: receipt %s: %v", b.Hash, receipts[i].TransactionHash, err)
+		}
+	}
+	root := types.DeriveSha(rs, trie.NewStackTrie(nil))
+	if root.Hex() != b.ReceiptsRoot {
+		return invalid("block %s: receipts root is %s", b.Hash, root.Hex())
+	}
+	return nil
+}
+
+// rebuilds the header, optional fields are only set if the node returned them
+func (b *RawBlock) header() (*types.Header, error) {
+	h := &types.Header{
+		ParentHash:  ethcommon.HexToHash(b.ParentHash),
+		UncleHash:   ethcommon.HexToHash(b.Sha3Uncles),
+		Coinbase:    ethcommon.HexToAddress(b.Miner),
+		Root:        ethcommon.HexToHash(b.StateRoot),
+		TxHash:      ethcommon.HexToHash(b.TransactionsRoot),
+		ReceiptHash: ethcommon.HexToHash(b.ReceiptsRoot),
+		MixDigest:   ethcommon.HexToHash(b.MixHash),
+	}
+	var err error
+	if h.Difficulty, err = util.DecodeBig(b.Difficulty); err != nil {
+		return nil, fmt.Errorf("difficulty: %w", err)
+	}
+	if h.Number, err = util.DecodeBig(b.Number); err != nil {
+		return nil, fmt.Errorf("number: %w", err)
+	}
+	if h.GasLimit, err = util.DecodeUint64(b.GasLimit); err != nil {
+		return nil, fmt.Errorf("gasLimit: %w", err)
+	}
+	if h.GasUsed, err = util.DecodeUint64(b.GasUsed); err != nil {
+		return nil, fmt.Errorf("gasUsed: %w", err)
+	}
+	if h.Time, err = util.DecodeUint64(b.Timestamp); err != nil {
+		return nil, fmt.Errorf("timestamp: %w", err)
+	}
+	if h.Extra, err = util.Decode(b.ExtraData); err != nil {
+		return nil, fmt.Errorf("extraData: %w", err)
+	}
+	bloom, err := util.Decode(b.LogsBloom)
+	if err != nil {
+		return nil, fmt.Errorf("logsBloom: %w", err)
+	}
+	h.Bloom = types.BytesToBloom(bloom)
+	nonce, err := util.Decode(b.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	copy(h.Nonce[:], nonce)
+
+	if b.BaseFeePerGas != "" {
+		if h.BaseFee, err = util.DecodeBig(b.BaseFeePerGas); err != nil {
+			return nil, fmt.Errorf("baseFeePerGas: %w", err)
+		}
+	}
+	if b.WithdrawalsRoot != "" {
+		root := ethcommon.HexToHash(b.WithdrawalsRoot)
+		h.WithdrawalsHash = &root
+	}
+	if b.BlobGasUsed != "" {
+		used, err := util.DecodeUint64(b.BlobGasUsed)
+		if err != nil {
+			return nil, fmt.Errorf("blobGasUsed: %w", err)
+		}
+		h.BlobGasUsed = &used
+	}
+	if b.ExcessBlobGas != "" {
+		excess, err := util.DecodeUint64(b.ExcessBlobGas)
+		if err != nil {
+			return nil, fmt.Errorf("excessBlobGas: %w", err)
+		}
+		h.ExcessBlobGas = &excess
+	}
+	if b.ParentBeaconBlockRoot != "" {
+		root := ethcommon.HexToHash(b.ParentBeaconBlockRoot)
+		h.ParentBeaconRoot = &root
+	}
+	return h, nil
+}
+
+// rebuilds the signed transaction, decoding only the fields the node set so
+// each transaction type gets the fields it requires
+func (rt *RawTransaction) consensus() (*types.Transaction, error) {
+	fields := make(map[string]interface{})
+	set := func(key, value string) {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	set("type", rt.Type)
+	set("chainId", rt.ChainId)
+	set("nonce", rt.Nonce)
+	set("to", rt.To)
+	set("gas", rt.Gas)
+	set("gasPrice", rt.GasPrice)
+	set("maxPriorityFeePerGas", rt.MaxPriorityFeePerGas)
+	set("maxFeePerGas", rt.MaxFeePerGas)
+	set("maxFeePerBlobGas", rt.MaxFeePerBlobGas)
+	set("value", rt.Value)
+	set("input", rt.Input)
+	set("v", rt.V)
+	set("r", rt.R)
+	set("s", rt.S)
+	set("yParity", rt.YParity)
+	if rt.AccessList != nil {
+		fields["accessList"] = rt.AccessList
+	}
+	if rt.BlobVersionedHashes != nil {
+		fields["blobVersionedHashes"] = rt.BlobVersionedHashes
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	tx := new(types.Transaction)
+	if err = tx.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// rebuilds the consensus fields of a receipt
+func (r *RawTransactionReceipt) consensus() (*types.Receipt, error) {
+	receipt := &types.Receipt{}
+	txType, err := decodeOptional(r.Type)
+	if err != nil {
+		return nil, fmt.Errorf("type: %w", err)
+	}
+	receipt.Type = uint8(txType)
+	if r.Root != "" {
+		// pre-byzantium
+		if receipt.PostState, err = util.Decode(r.Root); err != nil {
+			return nil, fmt.Errorf("root: %w", err)
+		}
+	} else if receipt.Status, err = util.DecodeUint64(r.Status); err != nil {
+		return nil, fmt.Errorf("status: %w", err)
+	}
+	if receipt.CumulativeGasUsed, err = util.DecodeUint64(r.CumulativeGasUsed); err != nil {
+		return nil, fmt.Errorf("cumulativeGasUsed: %w", err)
+	}
+	bloom, err := util.Decode(r.LogsBloom)
+	if err != nil {
+		return nil, fmt.Errorf("logsBloom: %w", err)
+	}
+	receipt.Bloom = types.BytesToBloom(bloom)
+	receipt.Logs = make([]*types.Log, len(r.Logs))
+	for i, l := range r.Logs {
+		data, err := util.Decode(l.Data)
+		if err != nil {
+			return nil, fmt.Errorf("log %s data: %w", l.LogIndex, err)
+		}
+		topics := make([]ethcommon.Hash, len(l.Topics))
+		for j, topic := range l.Topics {
+			topics[j] = ethcommon.HexToHash(topic)
+		}
+		receipt.Logs[i] = &types.Log{Address: ethcommon.HexToAddress(l.Address), Topics: topics, Data: data}
+	}
+	return receipt, nil
+}
+
+// decodes a hex quantity that may be omitted, e.g: the type of legacy
+// transactions on older nodes
+func decodeOptional(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return util.DecodeUint64(value)
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/iquidus/blockspider/disk"
+)
+
+// reads the test block and its receipts
+func readTestBlock(t *testing.T) (*RawBlock, []RawTransactionReceipt) {
+	var rawBlock RawBlock
+	if err := disk.ReadJsonFile[RawBlock](blockPath, &rawBlock); err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	var receipts []RawTransactionReceipt
+	if err := disk.ReadJsonFile[[]RawTransactionReceipt](receiptsPath, &receipts); err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	return &rawBlock, receipts
+}
+
+func TestVerify(t *testing.T) {
+	rawBlock, receipts := readTestBlock(t)
+	if err := rawBlock.VerifyHeader(); err != nil {
+		t.Error("TestVerify header err = ", err)
+	}
+	if err := rawBlock.VerifyReceipts(receipts); err != nil {
+		t.Error("TestVerify receipts err = ", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tamper func(b *RawBlock, receipts []RawTransactionReceipt)
+	}{
+		{"header", func(b *RawBlock, _ []RawTransactionReceipt) { b.GasUsed = "0x1" }},
+		{"transaction", func(b *RawBlock, _ []RawTransactionReceipt) { b.Transactions[5].Value = "0x1" }},
+		{"transactions", func(b *RawBlock, _ []RawTransactionReceipt) { b.Transactions = b.Transactions[1:] }},
+		{"log", func(_ *RawBlock, receipts []RawTransactionReceipt) { receipts[0].Logs[0].Data = "0x01" }},
+		{"status", func(_ *RawBlock, receipts []RawTransactionReceipt) { receipts[0].Status = "0x0" }},
+		{"receipts", func(_ *RawBlock, receipts []RawTransactionReceipt) {
+			receipts[0], receipts[1] = receipts[1], receipts[0]
+		}},
+	} {
+		rawBlock, receipts := readTestBlock(t)
+		c.tamper(rawBlock, receipts)
+		err := rawBlock.VerifyHeader()
+		if err == nil {
+			err = rawBlock.VerifyReceipts(receipts)
+		}
+		if !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("TestVerifyTampered(%s) err = %v; want %v", c.name, err, ErrInvalidBlock)
+		}
+	}
+}
+
+// fixtureService serves a single block and its receipts
+type fixtureService struct {
+	block    *RawBlock
+	receipts []RawTransactionReceipt
+}
+
+func (s *fixtureService) GetBlockByNumber(number string, full bool) *RawBlock {
+	return s.block
+}
+
+func (s *fixtureService) GetBlockReceipts(hash string) []RawTransactionReceipt {
+	return s.receipts
+}
+
+func serveFixture(t *testing.T, block *RawBlock, receipts []RawTransactionReceipt) *httptest.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &fixtureService{block, receipts}); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestVerifyFailover(t *testing.T) {
+	good, receipts := readTestBlock(t)
+	bad, badReceipts := readTestBlock(t)
+	bad.Transactions[5].Value = "0x1"
+	badReceipts[0].Logs[0].Data = "0x01"
+
+	// the primary serves a tampered block, then tampered receipts
+	primary := serveFixture(t, bad, receipts)
+	fallback := serveFixture(t, good, receipts)
+	client := newTestClient(t, &RPCConfig{
+		Type:     "http",
+		Endpoint: primary.URL,
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: fallback.URL}},
+		Retry:    fastRetry,
+		Verify:   true,
+	})
+	ctx := context.Background()
+
+	raw, err := client.GetBlockByHeight(ctx, blockNumber)
+	if err != nil || raw.Transactions[5].Value != good.Transactions[5].Value {
+		t.Fatalf("TestVerifyFailover block = %s, %v; want verified block", raw.Transactions[5].Value, err)
+	}
+
+	primary = serveFixture(t, good, badReceipts)
+	client = newTestClient(t, &RPCConfig{
+		Type:     "http",
+		Endpoint: primary.URL,
+		Nodes:    []RPCConfig{{Type: "http", Endpoint: fallback.URL}},
+		Retry:    fastRetry,
+		Verify:   true,
+	})
+	client.blockReceipts = true
+	block, err := client.ConvertBlock(ctx, &raw)
+	if err != nil || len(block.Logs) != logs || block.Logs[0].Data != receipts[0].Logs[0].Data {
+		t.Errorf("TestVerifyFailover convert err = %v; want verified receipts", err)
+	}
+
+	// every node serves the tampered block
+	client = newTestClient(t, &RPCConfig{Type: "http", Endpoint: serveFixture(t, bad, receipts).URL, Retry: fastRetry, Verify: true})
+	if _, err = client.GetBlockByHeight(ctx, blockNumber); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("TestVerifyFailover err = %v; want %v", err, ErrInvalidBlock)
+	}
+}
@@ -2,32 +2,55 @@ package crawler
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/iquidus/blockspider/common"
 	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/metrics"
 	"github.com/iquidus/blockspider/syncronizer"
 )
 
-func (c *Crawler) RunLoop() {
+var (
+	// ErrDeepReorg is returned when a reorg replaced every cached block and
+	// the block below them, so the common ancestor is unknown
+	ErrDeepReorg = errors.New("reorg deeper than the cache")
+
+	errCacheEmpty = errors.New("no blocks in cache to validate")
+)
+
+// saveBlocks is the most blocks synced between saves. Blocks are saved once
+// per sync, in a single bolt transaction with their messages, long syncs
+// are also saved every saveBlocks blocks.
+const saveBlocks = 100
+
+// RunLoop syncs the cache with the node's head. Cancelling ctx aborts the
+// sync, blocks already processed are saved.
+func (c *Crawler) RunLoop(ctx context.Context) {
+	c.updateStatus(func(s *Status) { s.Syncing = true })
 	// create log channel
 	c.logChan = make(chan *logObject)
 	// start crawling blocks
-	c.crawlBlocks()
+	c.crawlBlocks(ctx)
 	// close log channel
 	close(c.logChan)
 	// update crawler state
 	c.state.Syncing = false
+	c.updateStatus(func(s *Status) { s.Syncing = false })
 }
 
-func (c *Crawler) crawlBlocks() {
+func (c *Crawler) crawlBlocks(ctx context.Context) {
 	// check if a sync is already in progress
 	if c.state.Syncing {
 		c.logger.Warn("Sync already in progress; quitting.")
 		return
 	}
+	if halted := c.Status().Halted; halted != "" {
+		c.logger.Error("Sync halted, restart once resolved", "reason", halted)
+		return
+	}
 	// set syncing true to block additional syncs
 	c.state.Syncing = true
 
@@ -38,14 +61,21 @@ func (c *Crawler) crawlBlocks() {
 	}
 
 	c.logger.Debug("fetched block from local state", "number", localHead.Number)
+	metrics.SetLocalHead(localHead.Number)
 
 	// get remote head
-	chainHead, err := c.rpc.LatestBlockNumber()
+	chainHead, err := c.rpc.LatestBlockNumber(ctx)
 	if err != nil {
-		c.logger.Error("couldn't get block number", "err", err)
+		logRPCError(c.logger, "couldn't get block number", err)
+		return
 	}
+	metrics.SetRemoteHead(chainHead)
 	c.logger.Debug("fetched block from node", "number", chainHead)
 
+	// settle blocks the node has finalized since the last sync
+	c.updateFinalized(ctx)
+	c.settle()
+
 	// set current block to head + 1
 	currentBlock := localHead.Number + 1
 
@@ -55,28 +85,33 @@ func (c *Crawler) crawlBlocks() {
 	start := time.Now()
 	syncLogger.Debug("started sync at", "t", start)
 
-	// add new sync to task chain
-	taskChain := syncronizer.NewSync(c.cfg.MaxRoutines)
+	// add new sync to task chain, no new blocks are scheduled once
+	// shutdown starts but blocks in flight are drained
+	taskChain := syncronizer.NewSyncContext(c.stopping, c.cfg.MaxRoutines)
 	for ; currentBlock <= chainHead; currentBlock++ {
 		// capture blockNumber
 		b := currentBlock
 		// add link to task chain
 		taskChain.AddLink(func(r *syncronizer.Task) {
+			metrics.SyncTasks.Inc()
+			defer metrics.SyncTasks.Dec()
 			// get remote block
-			rawBlock, err := c.rpc.GetBlockByHeight(b)
+			rawBlock, err := c.rpc.GetBlockByHeight(ctx, b)
 			if err != nil {
-				syncLogger.Error("failed getting block", "err", err)
-				c.state.Syncing = false
+				logRPCError(syncLogger, "failed getting block", err)
 				r.AbortSync()
+				// tasks must link, even to abort, or the chain never finishes
+				r.Link()
 				return
 			}
 
 			// convert remote block to common.Block
-			block, err := rawBlock.Convert(c.rpc, nil)
+			block, err := c.rpc.ConvertBlock(ctx, &rawBlock)
 			if err != nil {
-				syncLogger.Error("failed converting block", "err", err)
-				c.state.Syncing = false
+				logRPCError(syncLogger, "failed converting block", err)
 				r.AbortSync()
+				// tasks must link, even to abort, or the chain never finishes
+				r.Link()
 				return
 			}
 
@@ -87,12 +122,14 @@ func (c *Crawler) crawlBlocks() {
 				return
 			}
 			// process
-			c.syncBlock(block, r)
+			c.syncBlock(ctx, block, r)
 		})
 	}
 
 	abort := taskChain.Finish()
-	c.state.Save()
+	if err := c.save(); err != nil {
+		syncLogger.Error("Failed to save state", "err", err)
+	}
 	if abort {
 		syncLogger.Debug("Aborted sync")
 	} else {
@@ -102,14 +139,15 @@ func (c *Crawler) crawlBlocks() {
 
 // validates local head against remote block with same height
 // returns the valid block, dropped block, isValid, error
-func (c *Crawler) validateBlock() (*common.Block, *common.Block, bool, error) {
+func (c *Crawler) validateBlock(ctx context.Context) (*common.Block, *common.Block, bool, error) {
 	// if there's no blocks in chain bail out
 	if c.state.Cache.Count() > 0 {
 		// remove local block from cache
 		local, _ := c.state.Cache.Pop()
 		// fetch remote block from node
-		rawRemote, err := c.rpc.GetBlockByHeight(local.Number)
+		rawRemote, err := c.rpc.GetBlockByHeight(ctx, local.Number)
 		if err != nil {
+			c.state.Cache.Push(local)
 			return nil, nil, false, err
 		}
 		// compares local and remote block hash
@@ -117,19 +155,96 @@ func (c *Crawler) validateBlock() (*common.Block, *common.Block, bool, error) {
 			return &local, nil, true, nil
 		} else {
 			// convert remote block to common.Block
-			remote, err := rawRemote.Convert(c.rpc, nil)
+			remote, err := c.rpc.ConvertBlock(ctx, &rawRemote)
 			if err != nil {
+				c.state.Cache.Push(local)
 				return nil, nil, false, err
 			}
 			return &remote, &local, false, nil
 		}
 	} else {
-		return nil, nil, false, errors.New("No blocks in chain to validate")
+		return nil, nil, false, errCacheEmpty
+	}
+}
+
+// deepAncestor returns the common ancestor once a reorg has replaced every
+// cached block, oldest being the last one. The node's parent of oldest is
+// the ancestor if its hash is the parent hash recorded in oldest, i.e: the
+// fork was as deep as the cache. Otherwise the fork is deeper than the
+// blocks kept locally, and per the DeepReorg mode either ErrDeepReorg is
+// returned or the chain below the cache is walked back, see walkBack.
+func (c *Crawler) deepAncestor(ctx context.Context, oldest *common.Block) (ancestor *common.Block, dropped, sidechain []common.Block, deep bool, err error) {
+	if oldest.Number == 0 {
+		return nil, nil, nil, false, fmt.Errorf("%w: genesis block %s replaced", ErrDeepReorg, oldest.Hash)
+	}
+	raw, err := c.rpc.GetBlockByHeight(ctx, oldest.Number-1)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	parent, err := c.rpc.ConvertBlock(ctx, &raw)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	if parent.Hash == oldest.ParentHash {
+		return &parent, nil, nil, false, nil
+	}
+	metrics.DeepReorgs.Inc()
+	if c.cfg.DeepReorg != DeepReorgRecover {
+		return nil, nil, nil, false, fmt.Errorf("%w: block %d %s replaced by %s", ErrDeepReorg, parent.Number, oldest.ParentHash, parent.Hash)
+	}
+	return c.walkBack(ctx, &parent, oldest.ParentHash)
+}
+
+// walkBack finds the ancestor of a fork deeper than the cache, from the
+// node's block head and the hash of the replaced block at the same height.
+// Replaced blocks are fetched by hash and returned as dropped, head-first,
+// with the node's blocks that replaced them as sidechain, until their parents
+// match. If a replaced block isn't served by the node, or DeepReorgLimit
+// blocks were walked, the node's lowest block is the ancestor with deep set.
+func (c *Crawler) walkBack(ctx context.Context, head *common.Block, replaced string) (ancestor *common.Block, dropped, sidechain []common.Block, deep bool, err error) {
+	limit := c.cfg.DeepReorgLimit
+	if limit <= 0 {
+		limit = DefaultDeepReorgLimit
+	}
+	for i := 0; i < limit && head.Number > 0; i++ {
+		old, err := c.blockByHash(ctx, replaced)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, nil, false, ctx.Err()
+			}
+			logRPCError(c.logger, "couldn't get replaced block", err)
+			break
+		}
+		dropped = append(dropped, old)
+		sidechain = append(sidechain, *head)
+		parent, err := c.blockByHash(ctx, head.ParentHash)
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+		if parent.Hash == old.ParentHash {
+			c.logger.Warn("Reorg deeper than the cache, found ancestor on the node", "number", parent.Number, "hash", parent.Hash, "depth", len(sidechain))
+			return &parent, dropped, sidechain, false, nil
+		}
+		head, replaced = &parent, old.ParentHash
+	}
+	c.logger.Warn("Reorg deeper than the cache, resuming from the node's chain", "number", head.Number, "hash", head.Hash, "replaced", replaced)
+	return head, dropped, sidechain, true, nil
+}
+
+// fetches and converts the block with hash
+func (c *Crawler) blockByHash(ctx context.Context, hash string) (common.Block, error) {
+	raw, err := c.rpc.GetBlockByHash(ctx, hash)
+	if err != nil {
+		return common.Block{}, err
 	}
+	return c.rpc.ConvertBlock(ctx, &raw)
 }
 
-func (c *Crawler) reorg() error {
-	var commonAncestor *common.Block
+func (c *Crawler) reorg(ctx context.Context) error {
+	var (
+		commonAncestor *common.Block
+		deep           bool // the ancestor is below the cache, see deepAncestor
+	)
 	sidechainmap := make(map[uint64]common.Block)
 	sidechain := []common.Block{}
 	dropped := []common.Block{}
@@ -138,7 +253,28 @@ func (c *Crawler) reorg() error {
 		// loop until common ancestor is found
 		if commonAncestor == nil {
 			// compare local "head" against remote block
-			b, d, ok, _ := c.validateBlock()
+			b, d, ok, err := c.validateBlock(ctx)
+			if errors.Is(err, errCacheEmpty) && len(dropped) > 0 {
+				// every cached block was replaced
+				// blocks below the cache, replaced and replacing
+				var oldBelow, newBelow []common.Block
+				b, oldBelow, newBelow, deep, err = c.deepAncestor(ctx, &dropped[len(dropped)-1])
+				ok = err == nil
+				dropped = append(dropped, oldBelow...)
+				sidechain = append(sidechain, newBelow...)
+			}
+			if err != nil {
+				// restore the blocks popped so far, the next sync detects
+				// the reorg again
+				for i := len(dropped) - 1; i >= 0; i-- {
+					c.state.Cache.Push(dropped[i])
+				}
+				if ctx.Err() != nil {
+					// shutting down, the remaining blocks are resynced on restart
+					return ctx.Err()
+				}
+				return err
+			}
 			if !ok && b != nil {
 				// if compare fails check to make sure we are not already
 				// handling this block
@@ -165,121 +301,82 @@ func (c *Crawler) reorg() error {
 	c.logger.Warn("Common ancestor found", "block", commonAncestor.Number, "hash", commonAncestor.Hash)
 	// common ancestor was popped off the chain during above loop, push it back on
 	c.state.Cache.Push(*commonAncestor)
+	c.rewindSettled(commonAncestor.Number)
+	if deep {
+		// the node's block replaced one that was never cached
+		c.state.Stage(kafka.StatusAccepted, *commonAncestor)
+	}
 
 	// process old blocks
 	for i := 0; i < len(dropped); i++ {
 		c.logger.Warn("Dropping local block", "number", dropped[i].Number, "hash", dropped[i].Hash)
-		err := c.sendReorgHooks(dropped[i])
-		if err != nil {
-			return errors.New("Failed to send reorg hook: " + err.Error())
-		}
+		c.state.Stage(kafka.StatusDropped, dropped[i])
 	}
 
 	// process new blocks
 	for i := len(sidechain) - 1; i >= 0; i-- {
 		c.state.Cache.Push(sidechain[i])
 		c.logger.Info("Adding remote block", "number", sidechain[i].Number, "hash", sidechain[i].Hash)
-		err := c.sendBlockMessage(&dropped[i])
-		if err != nil {
-			return errors.New("Failed to send reorg hook: " + err.Error())
-		}
+		c.state.Stage(kafka.StatusAccepted, sidechain[i])
 	}
 
-	return nil
-}
-
-func includes(addresses []string, a string) bool {
-	for _, addr := range addresses {
-		if addr == a {
-			return true
-		}
+	// dropped and sidechain are ordered head first
+	record := common.Reorg{
+		Ancestor: common.BlockRef{Number: commonAncestor.Number, Hash: commonAncestor.Hash},
+		Dropped:  make([]string, len(dropped)),
+		Added:    make([]string, len(sidechain)),
+		Depth:    len(sidechain),
+		Time:     time.Now().Unix(),
+		Deep:     deep,
 	}
-
-	return false
-}
-
-// filterLogs creates a slice of logs matching the given criteria.
-func filterLogs(logs []common.Log, addresses []string, topics []string) []common.Log {
-	var ret []common.Log
-Logs:
-	for _, log := range logs {
-		if len(addresses) > 0 && !includes(addresses, log.Address) {
-			continue
-		}
-		// If the to filtered topics is greater than the amount of topics in logs, skip.
-		if len(topics) > len(log.Topics) {
-			continue Logs
-		}
-		for i, sub := range topics {
-			match := len(sub) == 0 // empty rule set == wildcard
-			for _, topic := range sub {
-				if log.Topics[i] == string(topic) {
-					match = true
-					break
-				}
-			}
-			if !match {
-				continue Logs
-			}
-		}
-		ret = append(ret, log)
+	for i := range dropped {
+		record.Dropped[len(dropped)-1-i] = dropped[i].Hash
 	}
-	return ret
-}
+	for i := range sidechain {
+		record.Added[len(sidechain)-1-i] = sidechain[i].Hash
+	}
+	c.state.StageReorg(kafka.StatusReorg, record)
+	c.settle()
 
-func (c *Crawler) sendBlockMessage(block *common.Block) error {
-	for _, ktopic := range *c.writer.Params {
-		nb := block
-		filteredLogs := filterLogs(nb.Logs, ktopic.Addresses, ktopic.Topics)
-		nb.Logs = filteredLogs
-		var bp = kafka.Payload{
-			Status:  "ACCEPTED",
-			Block:   *nb,
-			Version: 1,
-		}
-		payload, err := json.Marshal(bp)
-		if err != nil {
-			return err
-		}
-		err = c.writer.WriteMessages(context.Background(), payload, ktopic.Topic)
-		if err != nil {
-			return err
-		}
+	// record reorg messages, journal and new head together
+	err := c.save()
+	if err != nil {
+		return errors.New("Failed to save reorg: " + err.Error())
 	}
-	return nil
-}
 
-func (c *Crawler) sendReorgHooks(block common.Block) error {
-	for _, ktopic := range *c.writer.Params {
-		nb := block
-		filteredLogs := filterLogs(nb.Logs, ktopic.Addresses, ktopic.Topics)
-		nb.Logs = filteredLogs
-		var bp = kafka.Payload{
-			Status:  "DROPPED",
-			Block:   nb,
-			Version: 1,
-		}
-		payload, err := json.Marshal(bp)
-		if err != nil {
-			return err
-		}
-		err = c.writer.WriteMessages(context.Background(), payload, ktopic.Topic)
-		if err != nil {
-			return err
-		}
+	metrics.Reorgs.Inc()
+	metrics.ReorgDepth.Observe(float64(len(sidechain)))
+	for i := range sidechain {
+		processed(&sidechain[i])
+	}
+	if deep {
+		processed(commonAncestor)
 	}
+	c.updateStatus(func(s *Status) {
+		s.LastReorg = &Reorg{
+			Time:     time.Now(),
+			Depth:    len(sidechain),
+			Ancestor: Head{commonAncestor.Number, commonAncestor.Hash, commonAncestor.Timestamp},
+			Head:     s.Head,
+			Deep:     deep,
+		}
+		metrics.SetLocalHead(s.Head.Number)
+	})
+
 	return nil
 }
 
-func (c *Crawler) syncBlock(block common.Block, task *syncronizer.Task) {
+func (c *Crawler) syncBlock(ctx context.Context, block common.Block, task *syncronizer.Task) {
 	// get parent block from cache
 	parent, err := c.state.Cache.Peak()
 	if err == nil {
 		if parent.Hash != block.ParentHash {
 			// A reorg has occurred
 			c.logger.Warn("Chain reorg detected", "parent", parent.Number, "hash", parent.Hash, "block", block.Number, "hash", block.Hash, "parent", block.ParentHash)
-			err := c.reorg()
-			if err != nil {
+			err := c.reorg(ctx)
+			if errors.Is(err, ErrDeepReorg) {
+				c.halt(err)
+			} else if err != nil {
 				c.logger.Error("Failed to determine common ancestor", "err", err)
 			}
 			// abort sync
@@ -290,19 +387,45 @@ func (c *Crawler) syncBlock(block common.Block, task *syncronizer.Task) {
 		c.logger.Error("Failed to peak block cache", "err", err)
 	}
 
-	// handle block hook here
-	err = c.sendBlockMessage(&block)
-	if err != nil {
-		c.logger.Error("Failed to send block hook", "err", err)
-	}
-
-	// add block to cache for next iteration
+	// add block to cache for next iteration, staging the block message to
+	// be saved to the outbox with it
+	c.state.Stage(kafka.StatusAccepted, block)
 	c.state.Cache.Push(block)
+	c.settle()
+	c.unsaved++
+	if c.unsaved >= saveBlocks {
+		if err = c.save(); err != nil {
+			c.logger.Error("Failed to save blocks", "err", err)
+			task.AbortSync()
+			return
+		}
+	}
+	processed(&block)
+	metrics.SetLocalHead(block.Number)
+	c.updateStatus(nil)
 
 	// log
 	c.log(block.Number, len(block.Transactions), len(block.Logs))
 }
 
+// saves the cache with the staged messages and wakes the outbox to
+// deliver them
+func (c *Crawler) save() error {
+	if err := c.state.Save(); err != nil {
+		return err
+	}
+	c.unsaved = 0
+	c.outbox.Notify()
+	return nil
+}
+
+// halts syncing after a reorg deeper than the cache, until restarted. The
+// cache is left as it was before the reorg.
+func (c *Crawler) halt(err error) {
+	c.logger.Error("Halting sync, raise state.cache and reset state, or restart with crawler.deepReorg set to recover", "err", err)
+	c.updateStatus(func(s *Status) { s.Halted = err.Error() })
+}
+
 func (c *Crawler) log(blockNo uint64, txns int, logs int) {
 	c.logChan <- &logObject{
 		blockNo: blockNo,
@@ -310,3 +433,28 @@ func (c *Crawler) log(blockNo uint64, txns int, logs int) {
 		logs:    logs,
 	}
 }
+
+// logs an rpc error that aborted a sync. Retryable errors outlasted the rpc
+// client's retries, e.g: the node is down or throttling, the next sync
+// starts over from the cached head.
+func logRPCError(logger log.Logger, msg string, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		logger.Debug(msg, "err", err)
+	case errors.Is(err, common.ErrBlockNotFound):
+		// the node reported a head it can't serve yet, e.g: behind a load
+		// balancer, sync stops at the last available block
+		logger.Info(msg+", stopping at last available block", "err", err)
+	case common.IsRetryable(err):
+		logger.Warn(msg+", retrying next sync", "err", err)
+	default:
+		logger.Error(msg, "err", err)
+	}
+}
+
+// records a block added to the canonical chain
+func processed(block *common.Block) {
+	metrics.Blocks.Inc()
+	metrics.Txns.Add(float64(len(block.Transactions)))
+	metrics.Logs.Add(float64(len(block.Logs)))
+}
@@ -0,0 +1,259 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/fakenode"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/util"
+)
+
+func serveTestNode(t *testing.T, node *fakenode.Node) *common.RPCClient {
+	ts := httptest.NewServer(node.Handler())
+	t.Cleanup(ts.Close)
+	t.Cleanup(node.Close)
+	return newTestClient(t, &common.RPCConfig{Type: "http", Endpoint: ts.URL})
+}
+
+// returns the node's canonical hash of block n
+func hashAt(t *testing.T, node *fakenode.Node, n uint64) string {
+	b, ok := node.Block(n)
+	if !ok {
+		t.Fatalf("hashAt(%d) = no block", n)
+	}
+	return b.Hash
+}
+
+// returns the node's canonical hashes of blocks from-to
+func hashesAt(t *testing.T, node *fakenode.Node, from, to uint64) []string {
+	var hashes []string
+	for n := from; n <= to; n++ {
+		hashes = append(hashes, hashAt(t, node, n))
+	}
+	return hashes
+}
+
+// returns a crawler for node, with the genesis block cached
+func crawlNode(t *testing.T, cfg *Config, node *fakenode.Node) *Crawler {
+	c := newTestCrawler(t, cfg)
+	c.rpc = serveTestNode(t, node)
+	c.state.Cache.Push(common.Block{Number: 0, Hash: hashAt(t, node, 0)})
+	return c
+}
+
+func TestCrawlUnavailableBlocks(t *testing.T) {
+	// the node reports 10 as its head but only serves up to 7
+	node := fakenode.New(&fakenode.Config{})
+	node.Mine(7)
+	node.SetLag(3)
+	c := crawlNode(t, &Config{MaxRoutines: 2}, node)
+
+	c.RunLoop(context.Background())
+
+	head, err := c.state.Cache.Peak()
+	if err != nil {
+		t.Fatal("Error reading cache head: ", err)
+	}
+	if head.Number != 7 || head.Hash != hashAt(t, node, 7) {
+		t.Errorf("TestCrawlUnavailableBlocks head = %d %s; want 7 %s", head.Number, head.Hash, hashAt(t, node, 7))
+	}
+	// no zero-valued blocks past the last available one
+	checkNumbers(t, "TestCrawlUnavailableBlocks accepted", pendingNumbers(t, c.state, kafka.StatusAccepted), 1, 7)
+}
+
+func TestCrawlSaveBlocks(t *testing.T) {
+	node := fakenode.New(&fakenode.Config{})
+	node.Mine(2*saveBlocks + 50)
+	c := crawlNode(t, &Config{MaxRoutines: 4}, node)
+
+	c.RunLoop(context.Background())
+
+	// every block is saved with its message by the end of the sync, without
+	// a save per block
+	messages, err := c.state.Pending(1000)
+	if err != nil {
+		t.Fatal("Error reading outbox: ", err)
+	}
+	if len(messages) != 2*saveBlocks+50 || c.unsaved != 0 {
+		t.Fatalf("TestCrawlSaveBlocks outbox = %d messages, %d unsaved; want %d, 0", len(messages), c.unsaved, 2*saveBlocks+50)
+	}
+	for i, m := range messages {
+		if m.Block.Number != uint64(i+1) || m.Status != kafka.StatusAccepted {
+			t.Fatalf("TestCrawlSaveBlocks message %d = %s %d; want ACCEPTED %d", i, m.Status, m.Block.Number, i+1)
+		}
+	}
+	if cursor, err := c.state.Cursor(); err != nil || cursor.Hash != hashAt(t, node, 2*saveBlocks+50) {
+		t.Errorf("TestCrawlSaveBlocks cursor = %+v, %v; want the head", cursor, err)
+	}
+}
+
+func TestCrawlReorg(t *testing.T) {
+	node := fakenode.New(&fakenode.Config{})
+	node.Mine(10)
+	c := crawlNode(t, &Config{MaxRoutines: 2}, node)
+	c.RunLoop(context.Background())
+	pendingNumbers(t, c.state, kafka.StatusAccepted)
+
+	// blocks 8-10 are replaced
+	dropped := hashesAt(t, node, 8, 10)
+	if err := node.Reorg(3); err != nil {
+		t.Fatal("Error reorging: ", err)
+	}
+	node.Mine(1)
+	c.RunLoop(context.Background())
+
+	// the reorg message follows the dropped and accepted blocks it replaced
+	if err := c.state.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	messages, err := c.state.Pending(100)
+	if err != nil {
+		t.Fatal("Error reading outbox: ", err)
+	}
+	var statuses []string
+	for _, m := range messages {
+		statuses = append(statuses, m.Status)
+	}
+	want := "[DROPPED DROPPED DROPPED ACCEPTED ACCEPTED ACCEPTED REORG]"
+	if fmt.Sprint(statuses) != want {
+		t.Errorf("TestCrawlReorg messages = %v; want %s", statuses, want)
+	}
+
+	reorgs, err := c.Reorgs(10)
+	if err != nil {
+		t.Fatal("Error reading reorg journal: ", err)
+	}
+	if len(reorgs) != 1 {
+		t.Fatalf("TestCrawlReorg journal = %+v; want 1 reorg", reorgs)
+	}
+	r := reorgs[0]
+	if r.Ancestor.Number != 7 || r.Ancestor.Hash != hashAt(t, node, 7) || r.Depth != 3 {
+		t.Errorf("TestCrawlReorg reorg = %+v; want depth 3 from 7", r)
+	}
+	if fmt.Sprint(r.Dropped) != fmt.Sprint(dropped) {
+		t.Errorf("TestCrawlReorg dropped = %v; want %v", r.Dropped, dropped)
+	}
+	if added := hashesAt(t, node, 8, 10); fmt.Sprint(r.Added) != fmt.Sprint(added) {
+		t.Errorf("TestCrawlReorg added = %v; want %v", r.Added, added)
+	}
+}
+
+// crawls a 30 block chain, the cache keeps blocks 15-30
+func crawlDeepChain(t *testing.T, cfg *Config) (*Crawler, *fakenode.Node) {
+	node := fakenode.New(&fakenode.Config{})
+	node.Mine(30)
+	c := crawlNode(t, cfg, node)
+	c.RunLoop(context.Background())
+	pendingNumbers(t, c.state, kafka.StatusAccepted)
+	if oldest := c.state.Cache.Items()[c.state.Cache.Count()-1]; oldest.Number != 15 {
+		t.Fatalf("crawlDeepChain oldest cached = %d; want 15", oldest.Number)
+	}
+	return c, node
+}
+
+// replaces the blocks after fork and mines the next one
+func fork(t *testing.T, node *fakenode.Node, fork uint64) {
+	if err := node.Reorg(int(util.DecodeHex(node.Head().Number) - fork)); err != nil {
+		t.Fatal("Error reorging: ", err)
+	}
+	node.Mine(1)
+}
+
+func TestCrawlReorgCacheDepth(t *testing.T) {
+	c, node := crawlDeepChain(t, &Config{MaxRoutines: 2})
+
+	// every cached block is replaced, the block below them is kept
+	fork(t, node, 14)
+	c.RunLoop(context.Background())
+
+	checkNumbers(t, "TestCrawlReorgCacheDepth accepted", pendingNumbers(t, c.state, kafka.StatusAccepted), 15, 30)
+	reorgs, _ := c.Reorgs(1)
+	if len(reorgs) != 1 || reorgs[0].Ancestor.Hash != hashAt(t, node, 14) || reorgs[0].Depth != 16 || reorgs[0].Deep {
+		t.Errorf("TestCrawlReorgCacheDepth reorgs = %+v; want depth 16 from 14", reorgs)
+	}
+	if head, _ := c.state.Cache.Peak(); head.Hash != hashAt(t, node, 30) {
+		t.Errorf("TestCrawlReorgCacheDepth head = %s; want %s", head.Hash, hashAt(t, node, 30))
+	}
+}
+
+func TestCrawlDeepReorgHalt(t *testing.T) {
+	c, node := crawlDeepChain(t, &Config{MaxRoutines: 2})
+
+	old := hashAt(t, node, 30)
+	fork(t, node, 5)
+	c.RunLoop(context.Background())
+
+	if halted := c.Status().Halted; halted == "" {
+		t.Fatal("TestCrawlDeepReorgHalt halted = \"\"; want reason")
+	}
+	// the cache is left as it was and nothing is emitted
+	if head, _ := c.state.Cache.Peak(); head.Hash != old || c.state.Cache.Count() != 16 {
+		t.Errorf("TestCrawlDeepReorgHalt head = %d %s; want 30 %s", head.Number, head.Hash, old)
+	}
+	if dropped := pendingNumbers(t, c.state, kafka.StatusDropped); len(dropped) != 0 {
+		t.Errorf("TestCrawlDeepReorgHalt dropped = %v; want none", dropped)
+	}
+	if reorgs, _ := c.Reorgs(1); len(reorgs) != 0 {
+		t.Errorf("TestCrawlDeepReorgHalt reorgs = %+v; want none", reorgs)
+	}
+
+	// syncs stay halted
+	node.Mine(1)
+	c.RunLoop(context.Background())
+	if head, _ := c.state.Cache.Peak(); head.Number != 30 {
+		t.Errorf("TestCrawlDeepReorgHalt head after halt = %d; want 30", head.Number)
+	}
+}
+
+func TestCrawlDeepReorgRecover(t *testing.T) {
+	c, node := crawlDeepChain(t, &Config{MaxRoutines: 2, DeepReorg: DeepReorgRecover})
+
+	fork(t, node, 5)
+	c.RunLoop(context.Background())
+
+	if halted := c.Status().Halted; halted != "" {
+		t.Fatalf("TestCrawlDeepReorgRecover halted = %s; want \"\"", halted)
+	}
+	// the replaced blocks below the cache are fetched by hash back to the fork
+	pending := pendingByStatus(t, c.state)
+	checkNumbers(t, "TestCrawlDeepReorgRecover accepted", pending[kafka.StatusAccepted], 6, 30)
+	// dropped head-first
+	sort.Slice(pending[kafka.StatusDropped], func(i, j int) bool { return pending[kafka.StatusDropped][i] < pending[kafka.StatusDropped][j] })
+	checkNumbers(t, "TestCrawlDeepReorgRecover dropped", pending[kafka.StatusDropped], 6, 30)
+	reorgs, _ := c.Reorgs(1)
+	if len(reorgs) != 1 || reorgs[0].Ancestor.Hash != hashAt(t, node, 5) || reorgs[0].Deep {
+		t.Errorf("TestCrawlDeepReorgRecover reorgs = %+v; want from 5", reorgs)
+	}
+	if head, _ := c.state.Cache.Peak(); head.Hash != hashAt(t, node, 30) {
+		t.Errorf("TestCrawlDeepReorgRecover head = %s; want %s", head.Hash, hashAt(t, node, 30))
+	}
+
+	// syncing carries on from the new chain
+	c.RunLoop(context.Background())
+	if head, _ := c.state.Cache.Peak(); head.Hash != hashAt(t, node, 31) {
+		t.Errorf("TestCrawlDeepReorgRecover head = %s; want %s", head.Hash, hashAt(t, node, 31))
+	}
+}
+
+func TestCrawlDeepReorgRecoverLimit(t *testing.T) {
+	c, node := crawlDeepChain(t, &Config{MaxRoutines: 2, DeepReorg: DeepReorgRecover, DeepReorgLimit: 3})
+
+	fork(t, node, 5)
+	c.RunLoop(context.Background())
+
+	// the walk stops 3 blocks below the cache, the node's block below them
+	// is accepted as the ancestor
+	pending := pendingByStatus(t, c.state)
+	checkNumbers(t, "TestCrawlDeepReorgRecoverLimit accepted", pending[kafka.StatusAccepted], 11, 30)
+	sort.Slice(pending[kafka.StatusDropped], func(i, j int) bool { return pending[kafka.StatusDropped][i] < pending[kafka.StatusDropped][j] })
+	checkNumbers(t, "TestCrawlDeepReorgRecoverLimit dropped", pending[kafka.StatusDropped], 12, 30)
+	reorgs, _ := c.Reorgs(1)
+	if len(reorgs) != 1 || reorgs[0].Ancestor.Hash != hashAt(t, node, 11) || !reorgs[0].Deep {
+		t.Errorf("TestCrawlDeepReorgRecoverLimit reorgs = %+v; want deep from 11", reorgs)
+	}
+}
@@ -1,51 +1,122 @@
 package crawler
 
 import (
-	"os"
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/iquidus/blockspider/common"
-	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/outbox"
 	"github.com/iquidus/blockspider/state"
 )
 
 type Config struct {
-	Interval    string `json:"interval"`
-	MaxRoutines int    `json:"routines"`
-	CacheLimit  int    `json:"cache"`
-	Start       uint64 `json:"start"`
+	Interval       string `json:"interval"`
+	MaxRoutines    int    `json:"routines"`
+	CacheLimit     int    `json:"cache"`
+	Start          uint64 `json:"start"`
+	Confirmations  uint64 `json:"confirmations"`  // emit CONFIRMED this many blocks behind the head (0 = disabled)
+	Finality       string `json:"finality"`       // emit FINALIZED up to the "safe" or "finalized" block ("" = disabled)
+	Subscribe      bool   `json:"subscribe"`      // sync on newHeads notifications, polling only while unsubscribed (ws/ipc only)
+	DeepReorg      string `json:"deepReorg"`      // on a reorg deeper than the cache, DeepReorgHalt or DeepReorgRecover ("" = DeepReorgHalt)
+	DeepReorgLimit int    `json:"deepReorgLimit"` // max blocks below the cache walked back in recover mode (0 = DefaultDeepReorgLimit)
 }
 
+// deep reorg modes
+const (
+	DeepReorgHalt    = "halt"    // stop syncing until an operator intervenes
+	DeepReorgRecover = "recover" // walk back below the cache to the ancestor on the node
+)
+
+// DefaultDeepReorgLimit is the default DeepReorgLimit
+const DefaultDeepReorgLimit = 128
+
 type Crawler struct {
-	// backend *storage.MongoDB
 	rpc     *common.RPCClient
 	cfg     *Config
 	logChan chan *logObject
 	state   *state.State
 	logger  log.Logger
-	writer  *kafka.Writer
+	outbox  *outbox.Dispatcher
+
+	stopping context.Context    // done once Shutdown is called
+	stop     context.CancelFunc // stops scheduling new blocks
+	done     chan struct{}      // closed when Run returns
+
+	finalized     uint64 // node's finality tag block, refreshed each sync
+	finalizedHash string
+
+	unsaved int // blocks synced since the last save, see saveBlocks
+
+	mu     sync.Mutex
+	status Status
 }
 
-func NewCrawler(cfg *Config, state *state.State, rpc *common.RPCClient, writer *kafka.Writer, logger log.Logger) *Crawler {
-	return &Crawler{rpc, cfg, make(chan *logObject), state, logger, writer}
+func NewCrawler(cfg *Config, state *state.State, rpc *common.RPCClient, outbox *outbox.Dispatcher, logger log.Logger) *Crawler {
+	stopping, stop := context.WithCancel(context.Background())
+	c := &Crawler{
+		rpc:      rpc,
+		cfg:      cfg,
+		logChan:  make(chan *logObject),
+		state:    state,
+		logger:   logger,
+		outbox:   outbox,
+		stopping: stopping,
+		stop:     stop,
+		done:     make(chan struct{}),
+	}
+	c.updateStatus(nil)
+	return c
 }
 
-func runCrawler(ticker *time.Ticker, c Crawler) {
-	c.RunLoop()
+// Run syncs with the node every interval, or on each new head if subscribed,
+// until Shutdown is called or ctx is done. Cancelling ctx aborts RPC calls in
+// flight, use Shutdown to stop gracefully.
+func (c *Crawler) Run(ctx context.Context) error {
+	defer close(c.done)
+	blockInterval, err := time.ParseDuration(c.cfg.Interval)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(blockInterval)
+	defer ticker.Stop()
+	c.logger.Info("Crawler interval set", "d", c.cfg.Interval)
+
+	heads := make(chan struct{}, 1)
+	var subscribed atomic.Bool
+	if c.cfg.Subscribe {
+		go c.watchHeads(ctx, heads, &subscribed)
+	}
+
 	for {
-		<-ticker.C
-		c.RunLoop()
+		c.RunLoop(ctx)
+		for next := false; !next; {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-c.stopping.Done():
+				return nil
+			case <-heads:
+				next = true
+			case <-ticker.C:
+				// no need to poll while subscribed
+				next = !subscribed.Load()
+			}
+		}
 	}
 }
 
-func Start(crawler *Crawler, cfg *Config, logger log.Logger) {
-	blockInterval, err := time.ParseDuration(cfg.Interval)
-	if err != nil {
-		logger.Error("can't parse crawler duration", "d", cfg.Interval, "err", err)
-		os.Exit(1)
+// Shutdown stops the crawler from scheduling new blocks and waits for blocks
+// in flight to be processed. If ctx is done first Shutdown returns its error,
+// the caller should then cancel the context passed to Run.
+func (c *Crawler) Shutdown(ctx context.Context) error {
+	c.stop()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	blockTicker := time.NewTicker(blockInterval)
-	logger.Info("Crawler interval set", "d", cfg.Interval)
-	go runCrawler(blockTicker, *crawler)
 }
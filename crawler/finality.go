@@ -0,0 +1,78 @@
+package crawler
+
+import (
+	"context"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/kafka"
+)
+
+// refreshes the node's finality tag block, if finality is enabled
+func (c *Crawler) updateFinalized(ctx context.Context) {
+	if c.cfg.Finality == "" {
+		return
+	}
+	number, hash, err := c.rpc.GetBlockByTag(ctx, c.cfg.Finality)
+	if err != nil {
+		c.logger.Warn("couldn't get finalized block", "tag", c.cfg.Finality, "err", err)
+		return
+	}
+	c.finalized, c.finalizedHash = number, hash
+}
+
+// settle stages CONFIRMED messages for cached blocks past the confirmation
+// depth and FINALIZED messages for cached blocks at or below the finality tag
+// block. Messages are saved with the next state save.
+func (c *Crawler) settle() {
+	items := c.state.Cache.Items()
+	if len(items) == 0 {
+		return
+	}
+	head := items[0].Number
+
+	if c.cfg.Confirmations > 0 && head >= c.cfg.Confirmations {
+		c.state.Confirmed = c.stageRange(items, kafka.StatusConfirmed, c.state.Confirmed, head-c.cfg.Confirmations)
+	}
+	if c.cfg.Finality != "" && c.finalized > c.state.Finalized {
+		target := c.finalized
+		if target > head {
+			target = head
+		}
+		// don't finalize a fork, the reorg will be handled by the next sync
+		for i := range items {
+			if items[i].Number == c.finalized && items[i].Hash != c.finalizedHash {
+				c.logger.Warn("Cached block does not match finalized block", "number", c.finalized, "hash", items[i].Hash, "finalized", c.finalizedHash)
+				return
+			}
+		}
+		c.state.Finalized = c.stageRange(items, kafka.StatusFinalized, c.state.Finalized, target)
+	}
+}
+
+// stages status for cached blocks numbered (from, to], oldest first, and
+// returns the new mark
+func (c *Crawler) stageRange(items []common.Block, status string, from, to uint64) uint64 {
+	if to <= from {
+		return from
+	}
+	// items are head first
+	for i := len(items) - 1; i >= 0; i-- {
+		if n := items[i].Number; n > from && n <= to {
+			c.state.Stage(status, items[i])
+		}
+	}
+	return to
+}
+
+// rewinds the confirmed and finalized marks after a reorg so blocks on the
+// new chain are settled again
+func (c *Crawler) rewindSettled(ancestor uint64) {
+	if c.state.Confirmed > ancestor {
+		c.logger.Warn("Reorg deeper than confirmation depth", "confirmed", c.state.Confirmed, "ancestor", ancestor)
+		c.state.Confirmed = ancestor
+	}
+	if c.state.Finalized > ancestor {
+		c.logger.Error("Reorg below finalized block", "finalized", c.state.Finalized, "ancestor", ancestor)
+		c.state.Finalized = ancestor
+	}
+}
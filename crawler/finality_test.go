@@ -0,0 +1,109 @@
+package crawler
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/outbox"
+	"github.com/iquidus/blockspider/state"
+)
+
+func newTestCrawler(t *testing.T, cfg *Config) *Crawler {
+	chainId := uint64(8)
+	s, err := state.Init(&state.Config{Path: filepath.Join(t.TempDir(), "state.db"), CacheLimit: 16}, &chainId)
+	if err != nil {
+		t.Fatal("Error initializing state: ", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return NewCrawler(cfg, s, nil, outbox.New(s, nil, log.New()), log.New())
+}
+
+func testBlock(n uint64) common.Block {
+	return common.Block{Number: n, Hash: fmt.Sprintf("0x%x", n)}
+}
+
+// returns the staged messages with status as block numbers
+func pendingNumbers(t *testing.T, s *state.State, status string) []uint64 {
+	return pendingByStatus(t, s)[status]
+}
+
+// acks the pending messages, returning their block numbers by status
+func pendingByStatus(t *testing.T, s *state.State) map[string][]uint64 {
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	messages, err := s.Pending(100)
+	if err != nil {
+		t.Fatal("Error reading outbox: ", err)
+	}
+	numbers := make(map[string][]uint64)
+	var seqs []uint64
+	for _, m := range messages {
+		numbers[m.Status] = append(numbers[m.Status], m.Block.Number)
+		seqs = append(seqs, m.Seq)
+	}
+	if err = s.Ack(seqs...); err != nil {
+		t.Fatal("Error acking outbox: ", err)
+	}
+	return numbers
+}
+
+func checkNumbers(t *testing.T, name string, got []uint64, first, last uint64) {
+	t.Helper()
+	if uint64(len(got)) != last-first+1 {
+		t.Fatalf("%s = %v; want %d-%d", name, got, first, last)
+	}
+	for i, n := range got {
+		if n != first+uint64(i) {
+			t.Fatalf("%s = %v; want %d-%d", name, got, first, last)
+		}
+	}
+}
+
+func TestSettleConfirmations(t *testing.T) {
+	c := newTestCrawler(t, &Config{Confirmations: 3})
+	for i := uint64(1); i <= 10; i++ {
+		c.state.Cache.Push(testBlock(i))
+	}
+	c.settle()
+	checkNumbers(t, "TestSettleConfirmations confirmed", pendingNumbers(t, c.state, kafka.StatusConfirmed), 1, 7)
+
+	c.state.Cache.Push(testBlock(11))
+	c.settle()
+	checkNumbers(t, "TestSettleConfirmations confirmed", pendingNumbers(t, c.state, kafka.StatusConfirmed), 8, 8)
+
+	// a reorg past the confirmation depth confirms the new blocks again
+	c.rewindSettled(6)
+	c.settle()
+	checkNumbers(t, "TestSettleConfirmations reconfirmed", pendingNumbers(t, c.state, kafka.StatusConfirmed), 7, 8)
+}
+
+func TestSettleFinality(t *testing.T) {
+	c := newTestCrawler(t, &Config{Finality: "finalized"})
+	for i := uint64(1); i <= 10; i++ {
+		c.state.Cache.Push(testBlock(i))
+	}
+
+	// cached block doesn't match the finalized block
+	c.finalized, c.finalizedHash = 5, "0xfork"
+	c.settle()
+	if got := pendingNumbers(t, c.state, kafka.StatusFinalized); len(got) != 0 {
+		t.Errorf("TestSettleFinality finalized fork = %v; want none", got)
+	}
+
+	c.finalized, c.finalizedHash = 5, testBlock(5).Hash
+	c.settle()
+	checkNumbers(t, "TestSettleFinality finalized", pendingNumbers(t, c.state, kafka.StatusFinalized), 1, 5)
+
+	// finalized block ahead of the cached head
+	c.finalized, c.finalizedHash = 20, "0x14"
+	c.settle()
+	checkNumbers(t, "TestSettleFinality finalized", pendingNumbers(t, c.state, kafka.StatusFinalized), 6, 10)
+	if c.state.Finalized != 10 {
+		t.Errorf("TestSettleFinality mark = %d; want 10", c.state.Finalized)
+	}
+}
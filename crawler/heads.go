@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/metrics"
+	"github.com/iquidus/blockspider/util"
+)
+
+const (
+	minResubscribe = time.Second      // initial resubscribe delay
+	maxResubscribe = 64 * time.Second // max resubscribe delay
+)
+
+// watchHeads subscribes to newHeads and signals heads for each new head.
+// subscribed is true while the subscription is up, the crawler polls
+// otherwise. Dropped subscriptions are retried with exponential backoff.
+func (c *Crawler) watchHeads(ctx context.Context, heads chan<- struct{}, subscribed *atomic.Bool) {
+	backoff := time.Duration(0)
+	for {
+		ch := make(chan *common.RawHeader, 16)
+		sub, err := c.rpc.SubscribeNewHeads(ctx, ch)
+		if errors.Is(err, common.ErrSubscriptionsUnsupported) {
+			c.logger.Warn("rpc transport does not support subscriptions, polling instead", "err", err)
+			return
+		}
+		if err == nil {
+			c.logger.Info("Subscribed to new heads")
+			subscribed.Store(true)
+			err = c.receiveHeads(ctx, ch, sub, heads, &backoff)
+			subscribed.Store(false)
+			sub.Unsubscribe()
+			if err == nil {
+				// crawler stopped
+				return
+			}
+		}
+
+		if backoff == 0 {
+			backoff = minResubscribe
+		} else if backoff < maxResubscribe {
+			backoff *= 2
+		}
+		c.logger.Warn("New heads subscription failed, polling until resubscribed", "in", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopping.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// receives heads until the subscription fails, returning its error, or the
+// crawler stops, returning nil
+func (c *Crawler) receiveHeads(ctx context.Context, ch <-chan *common.RawHeader, sub common.Subscription, heads chan<- struct{}, backoff *time.Duration) error {
+	for {
+		select {
+		case h := <-ch:
+			// subscription is healthy once it delivers a head
+			*backoff = 0
+			metrics.SetRemoteHead(util.DecodeHex(h.Number))
+			select {
+			case heads <- struct{}{}:
+			default:
+			}
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		case <-c.stopping.Done():
+			return nil
+		}
+	}
+}
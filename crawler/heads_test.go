@@ -0,0 +1,149 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/iquidus/blockspider/common"
+)
+
+// testHeadsService serves newHeads subscriptions
+type testHeadsService struct {
+	heads chan *common.RawHeader
+}
+
+func (s *testHeadsService) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, ok := rpc.NotifierFromContext(ctx)
+	if !ok {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	go func() {
+		for {
+			select {
+			case h := <-s.heads:
+				notifier.Notify(sub.ID, h)
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// testHeadsServer serves svc over websockets, restart drops all connections
+type testHeadsServer struct {
+	*httptest.Server
+	svc    *testHeadsService
+	server atomic.Pointer[rpc.Server]
+}
+
+func newTestHeadsServer(t *testing.T, svc *testHeadsService) *testHeadsServer {
+	s := &testHeadsServer{svc: svc}
+	s.restart(t)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.server.Load().WebsocketHandler([]string{"*"}).ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	t.Cleanup(func() { s.server.Load().Stop() })
+	return s
+}
+
+func (s *testHeadsServer) restart(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", s.svc); err != nil {
+		t.Fatal("Error registering service: ", err)
+	}
+	if old := s.server.Swap(server); old != nil {
+		old.Stop()
+	}
+}
+
+func newTestClient(t *testing.T, cfg *common.RPCConfig) *common.RPCClient {
+	client, err := common.NewRPCClient(cfg)
+	if err != nil {
+		t.Fatal("Error creating rpc client: ", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// waits up to timeout for cond to be true
+func eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWatchHeads(t *testing.T) {
+	svc := &testHeadsService{heads: make(chan *common.RawHeader)}
+	ts := newTestHeadsServer(t, svc)
+
+	c := newTestCrawler(t, &Config{Subscribe: true})
+	c.rpc = newTestClient(t, &common.RPCConfig{Type: "ws", Endpoint: "ws" + strings.TrimPrefix(ts.URL, "http")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heads := make(chan struct{}, 1)
+	var subscribed atomic.Bool
+	go c.watchHeads(ctx, heads, &subscribed)
+
+	if !eventually(5*time.Second, subscribed.Load) {
+		t.Fatal("TestWatchHeads not subscribed")
+	}
+	svc.heads <- &common.RawHeader{Number: "0x1", Hash: "0x01"}
+	select {
+	case <-heads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestWatchHeads no head received")
+	}
+
+	// dropped connections fall back to polling, then resubscribe
+	ts.restart(t)
+	if !eventually(5*time.Second, func() bool { return !subscribed.Load() }) {
+		t.Fatal("TestWatchHeads still subscribed after connection dropped")
+	}
+	if !eventually(5*time.Second, subscribed.Load) {
+		t.Fatal("TestWatchHeads did not resubscribe")
+	}
+	svc.heads <- &common.RawHeader{Number: "0x2", Hash: "0x02"}
+	select {
+	case <-heads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestWatchHeads no head received after resubscribing")
+	}
+}
+
+func TestWatchHeadsUnsupported(t *testing.T) {
+	svc := &testHeadsService{heads: make(chan *common.RawHeader)}
+	ts := newTestHeadsServer(t, svc)
+
+	c := newTestCrawler(t, &Config{Subscribe: true})
+	c.rpc = newTestClient(t, &common.RPCConfig{Type: "http", Endpoint: ts.URL})
+
+	done := make(chan struct{})
+	var subscribed atomic.Bool
+	go func() {
+		c.watchHeads(context.Background(), make(chan struct{}, 1), &subscribed)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestWatchHeadsUnsupported did not fall back to polling")
+	}
+	if subscribed.Load() {
+		t.Error("TestWatchHeadsUnsupported subscribed = true; want false")
+	}
+}
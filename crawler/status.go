@@ -0,0 +1,59 @@
+package crawler
+
+import (
+	"time"
+
+	"github.com/iquidus/blockspider/common"
+)
+
+// Head identifies the cached head block
+type Head struct {
+	Number    uint64 `json:"number"`
+	Hash      string `json:"hash"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// Reorg describes a chain reorg handled by the crawler
+type Reorg struct {
+	Time     time.Time `json:"time"`
+	Depth    int       `json:"depth"`    // number of blocks replaced
+	Ancestor Head      `json:"ancestor"` // common ancestor
+	Head     Head      `json:"head"`     // new head
+	Deep     bool      `json:"deep"`     // deeper than the cache, see common.Reorg
+}
+
+// Status is a snapshot of the crawler, safe to read while it runs
+type Status struct {
+	Head         Head      `json:"head"`
+	CacheDepth   int       `json:"cacheDepth"`
+	Syncing      bool      `json:"syncing"`
+	LastProgress time.Time `json:"lastProgress"` // last time a sync started, ended or added a block
+	LastReorg    *Reorg    `json:"lastReorg"`
+	Halted       string    `json:"halted,omitempty"` // why syncing stopped, e.g: a reorg deeper than the cache
+}
+
+// Status returns the crawler's current status
+func (c *Crawler) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// updates the status from the cache, called from the sync routine only
+func (c *Crawler) updateStatus(update func(s *Status)) {
+	head, _ := c.state.Cache.Peak()
+	depth := c.state.Cache.Count()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.Head = Head{head.Number, head.Hash, head.Timestamp}
+	c.status.CacheDepth = depth
+	c.status.LastProgress = time.Now()
+	if update != nil {
+		update(&c.status)
+	}
+}
+
+// Reorgs returns up to limit reorgs from the state journal, newest first
+func (c *Crawler) Reorgs(limit int) ([]common.Reorg, error) {
+	return c.state.Reorgs(limit)
+}
@@ -1,39 +1,157 @@
 package disk
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const (
+	checksumPrefix = "sha256:"
+	backupSuffix   = ".bak" // previous generation of a file
+	tempSuffix     = ".tmp" // file being written
+)
+
+var ErrChecksum = errors.New("checksum mismatch")
+
+// envelope wraps file contents with a checksum so truncated or corrupted
+// files are detected when read
+type envelope struct {
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// returns the checksum of compact json data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return checksumPrefix + hex.EncodeToString(sum[:])
+}
+
+// ReadJsonFile reads a json file into obj. Files written by
+// WriteCheckedJsonFile are also accepted, their checksum is verified.
 func ReadJsonFile[E any](path string, obj *E) error {
 	if obj == nil {
 		return errors.New("obj is nil")
 	}
+	return readJsonFile(path, obj)
+}
+
+// ReadCheckedJsonFile reads a json file written by WriteCheckedJsonFile into
+// obj. If the file is missing or corrupt the previous generation (path.bak)
+// is read instead.
+func ReadCheckedJsonFile[E any](path string, obj *E) error {
+	if obj == nil {
+		return errors.New("obj is nil")
+	}
+
+	err := readJsonFile(path, obj)
+	if err == nil {
+		return nil
+	}
+	// fall back to previous generation
+	var prev E
+	if bakErr := readJsonFile(path+backupSuffix, &prev); bakErr == nil {
+		*obj = prev
+		return nil
+	}
+	return err
+}
 
+func readJsonFile[E any](path string, obj *E) error {
 	file, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(file, obj)
-	if err != nil {
-		return err
+	var env envelope
+	if json.Unmarshal(file, &env) == nil && strings.HasPrefix(env.Checksum, checksumPrefix) && len(env.Data) > 0 {
+		var data bytes.Buffer
+		if err = json.Compact(&data, env.Data); err != nil {
+			return err
+		}
+		if checksum(data.Bytes()) != env.Checksum {
+			return ErrChecksum
+		}
+		return json.Unmarshal(data.Bytes(), obj)
 	}
-	return nil
+
+	return json.Unmarshal(file, obj)
 }
 
+// WriteJsonFile atomically writes obj to path as indented json
 func WriteJsonFile[E any](obj E, path string, perm fs.FileMode) error {
 	towrite, err := json.MarshalIndent(obj, "", "  ")
 	if err != nil {
 		return err
 	}
+	return writeAtomic(path, towrite, perm, false)
+}
+
+// WriteCheckedJsonFile atomically writes obj to path as json with a
+// checksum, keeping the previous generation as path.bak for
+// ReadCheckedJsonFile to fall back to.
+func WriteCheckedJsonFile[E any](obj E, path string, perm fs.FileMode) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	towrite, err := json.MarshalIndent(envelope{checksum(data), data}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, towrite, perm, true)
+}
+
+// writes data to a temp file and syncs it before replacing path, optionally
+// keeping the previous generation as path.bak
+func writeAtomic(path string, data []byte, perm fs.FileMode, backup bool) error {
+	tmp := path + tempSuffix
+	if err := writeSync(tmp, data, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if backup {
+		if err := os.Rename(path, path+backupSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
 
-	err = os.WriteFile(path, towrite, perm)
+// writes data to path and syncs it to disk
+func writeSync(path string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	return nil
+// syncs a directory so renames within it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
@@ -1,7 +1,9 @@
 package disk
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -50,3 +52,134 @@ func TestJsonFile(t *testing.T) {
 		t.Error("Error removing file: ", err)
 	}
 }
+
+type testGen struct {
+	Generation int
+	Name       string
+}
+
+func TestAtomicWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+	for i := 1; i <= 2; i++ {
+		err := WriteCheckedJsonFile[testGen](testGen{i, "test"}, path, 0644)
+		if err != nil {
+			t.Fatal("Error writing file: ", err)
+		}
+	}
+	// temp file is renamed into place
+	if _, err := os.Stat(path + tempSuffix); !os.IsNotExist(err) {
+		t.Errorf("TestAtomicWrite temp file exists: %v", err)
+	}
+	var got testGen
+	if err := ReadCheckedJsonFile[testGen](path, &got); err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	if got.Generation != 2 {
+		t.Errorf("TestAtomicWrite generation = %d; want 2", got.Generation)
+	}
+	// previous generation is kept
+	var bak testGen
+	if err := readJsonFile[testGen](path+backupSuffix, &bak); err != nil {
+		t.Fatal("Error reading backup: ", err)
+	}
+	if bak.Generation != 1 {
+		t.Errorf("TestAtomicWrite backup generation = %d; want 1", bak.Generation)
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+	for i := 1; i <= 2; i++ {
+		if err := WriteCheckedJsonFile[testGen](testGen{i, "test"}, path, 0644); err != nil {
+			t.Fatal("Error writing file: ", err)
+		}
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+
+	var tests = []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", file[:len(file)/2]},
+		{"empty", []byte{}},
+		{"corrupted", bytes.Replace(file, []byte(`"test"`), []byte(`"tset"`), 1)},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal("Error writing file: ", err)
+		}
+		if tt.name == "corrupted" {
+			// still valid json, only the checksum catches it
+			var got testGen
+			if err := readJsonFile[testGen](path, &got); err != ErrChecksum {
+				t.Errorf("TestPartialWrite %s err = %v; want %v", tt.name, err, ErrChecksum)
+			}
+		}
+		// falls back to previous generation
+		var got testGen
+		if err := ReadCheckedJsonFile[testGen](path, &got); err != nil {
+			t.Fatalf("TestPartialWrite %s err = %v", tt.name, err)
+		}
+		if got.Generation != 1 {
+			t.Errorf("TestPartialWrite %s generation = %d; want 1", tt.name, got.Generation)
+		}
+	}
+
+	// no good generation left
+	if err := os.WriteFile(path+backupSuffix, []byte("{"), 0644); err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+	var got testGen
+	if err := ReadCheckedJsonFile[testGen](path, &got); err == nil {
+		t.Error("TestPartialWrite err = nil; want error")
+	}
+}
+
+func TestPlainJsonFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+	if err := os.WriteFile(path, []byte(`{"Generation": 3, "Name": "plain"}`), 0644); err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+	var got testGen
+	if err := ReadJsonFile[testGen](path, &got); err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	if got.Generation != 3 || got.Name != "plain" {
+		t.Errorf("TestPlainJsonFile got = %v", got)
+	}
+}
+
+func TestStrictRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+	for i := 1; i <= 2; i++ {
+		if err := WriteJsonFile[testGen](testGen{i, "test"}, path, 0644); err != nil {
+			t.Fatal("Error writing file: ", err)
+		}
+	}
+	// plain json, without a checksum or previous generation
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	if bytes.Contains(file, []byte("checksum")) {
+		t.Errorf("TestStrictRead file = %s; want plain json", file)
+	}
+	if _, err := os.Stat(path + backupSuffix); !os.IsNotExist(err) {
+		t.Errorf("TestStrictRead backup file exists: %v", err)
+	}
+
+	// a previous generation is never read in place of a broken file
+	if err := WriteCheckedJsonFile[testGen](testGen{3, "test"}, path+backupSuffix, 0644); err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+	var got testGen
+	if err := ReadJsonFile[testGen](path, &got); err == nil {
+		t.Errorf("TestStrictRead got = %v; want error", got)
+	}
+}
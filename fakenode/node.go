@@ -0,0 +1,442 @@
+// Package fakenode is an in-memory Ethereum json-rpc node for tests. Tests
+// mine blocks, script reorgs, and inject errors and latency, then point an
+// RPCClient at a server for the node's Handler.
+package fakenode
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// ClientVersion is returned by web3_clientVersion
+const ClientVersion = "fakenode/v0.0.1"
+
+// json-rpc error code returned for an unknown block tag
+const unknownBlockCode = -39001
+
+// Error is a json-rpc error, inject one with Fail
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string  { return e.Message }
+func (e *Error) ErrorCode() int { return e.Code }
+
+// ErrLimitExceeded is the error node providers return when a request limit
+// is exceeded
+var ErrLimitExceeded = &Error{-32005, "limit exceeded"}
+
+// Tx describes a transaction to mine. Hashes, indices and the receipt are
+// filled in by the node.
+type Tx struct {
+	From  string
+	To    string
+	Value uint64
+	Input string
+	Gas   uint64 // gas used, 21000 if 0
+	Logs  []Log
+}
+
+// Log is a log emitted by a mined transaction
+type Log struct {
+	Address string
+	Topics  []string
+	Data    string
+}
+
+type Config struct {
+	// Txs returns the transactions of each block mined by Mine or Reorg,
+	// blocks are empty if nil
+	Txs func(number uint64) []Tx
+	// Now returns the timestamp of each mined block. If nil the genesis
+	// block is at unix time 0 and each block is BlockTime later.
+	Now func() time.Time
+}
+
+// BlockTime between mined blocks when Config.Now is nil
+const BlockTime = 2 * time.Second
+
+// a mined block and its receipts
+type block struct {
+	raw      common.RawBlock
+	receipts []common.RawTransactionReceipt
+}
+
+// failure is an injected error for the next count calls to method
+type failure struct {
+	method string // "" for any method
+	count  int
+	err    error
+}
+
+// Node is a chain of blocks served over json-rpc. It is safe for concurrent
+// use.
+type Node struct {
+	cfg    Config
+	server *rpc.Server
+
+	mu        sync.Mutex
+	chain     []*block          // canonical chain, by number
+	byHash    map[string]*block // every block mined, including replaced ones
+	txs       map[string]*block // canonical transactions by hash
+	forks     uint64            // reorgs so far, salts the hashes of new blocks
+	lag       uint64            // blocks past the head reported by eth_blockNumber
+	finalized *uint64           // served as the "safe" and "finalized" blocks
+	latency   time.Duration
+	failures  []*failure
+	http      []int // status codes to answer the next requests with
+	calls     map[string]int
+}
+
+// New returns a node with a genesis block
+func New(cfg *Config) *Node {
+	n := &Node{
+		cfg:    *cfg,
+		server: rpc.NewServer(),
+		byHash: make(map[string]*block),
+		txs:    make(map[string]*block),
+		calls:  make(map[string]int),
+	}
+	svc := &service{n}
+	if err := n.server.RegisterName("eth", svc); err != nil {
+		panic(err)
+	}
+	if err := n.server.RegisterName("web3", svc); err != nil {
+		panic(err)
+	}
+	n.mine(nil)
+	return n
+}
+
+// Handler serves the node's json-rpc api over http
+func (n *Node) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.mu.Lock()
+		var status int
+		if len(n.http) > 0 {
+			status, n.http = n.http[0], n.http[1:]
+		}
+		n.mu.Unlock()
+		if status != 0 {
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			w.WriteHeader(status)
+			return
+		}
+		n.server.ServeHTTP(w, r)
+	})
+}
+
+// Close stops serving json-rpc requests
+func (n *Node) Close() {
+	n.server.Stop()
+}
+
+// Mine appends count blocks to the chain
+func (n *Node) Mine(count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := 0; i < count; i++ {
+		n.mine(nil)
+	}
+}
+
+// MineTxs appends a block with txs to the chain
+func (n *Node) MineTxs(txs ...Tx) common.RawBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.mine(txs).raw
+}
+
+// Reorg replaces the last depth blocks with as many new ones. The replaced
+// blocks are still served by hash, but not by number.
+func (n *Node) Reorg(depth int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if depth <= 0 || depth >= len(n.chain) {
+		return fmt.Errorf("reorg depth %d must be between 1 and %d", depth, len(n.chain)-1)
+	}
+	for _, b := range n.chain[len(n.chain)-depth:] {
+		for _, tx := range b.raw.Transactions {
+			delete(n.txs, tx.Hash)
+		}
+	}
+	n.chain = n.chain[:len(n.chain)-depth]
+	n.forks++
+	for i := 0; i < depth; i++ {
+		n.mine(nil)
+	}
+	return nil
+}
+
+// Head returns the head block
+func (n *Node) Head() common.RawBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.chain[len(n.chain)-1].raw
+}
+
+// Block returns the canonical block with number
+func (n *Node) Block(number uint64) (common.RawBlock, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if number >= uint64(len(n.chain)) {
+		return common.RawBlock{}, false
+	}
+	return n.chain[number].raw, true
+}
+
+// Receipts returns the receipts of the canonical block with number
+func (n *Node) Receipts(number uint64) []common.RawTransactionReceipt {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if number >= uint64(len(n.chain)) {
+		return nil
+	}
+	return n.chain[number].receipts
+}
+
+// SetLag makes eth_blockNumber report a head lag blocks past the last block
+// served, like a node behind a load balancer
+func (n *Node) SetLag(lag uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lag = lag
+}
+
+// Finalize serves the block with number as the "safe" and "finalized" blocks
+func (n *Node) Finalize(number uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.finalized = &number
+}
+
+// SetLatency delays every call by d
+func (n *Node) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = d
+}
+
+// Fail makes the next count calls to method ("" for any method) return err.
+// Use an *Error for a json-rpc error with a code.
+func (n *Node) Fail(method string, count int, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failures = append(n.failures, &failure{method, count, err})
+}
+
+// FailHTTP answers the next count requests with an http status, e.g: 429 or
+// 503. 429 responses set Retry-After to 1 second.
+func (n *Node) FailHTTP(status int, count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := 0; i < count; i++ {
+		n.http = append(n.http, status)
+	}
+}
+
+// Calls returns the number of calls made to method
+func (n *Node) Calls(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[method]
+}
+
+// enter records a call to method, then waits for the latency and returns an
+// injected failure if there is one
+func (n *Node) enter(ctx context.Context, method string) error {
+	n.mu.Lock()
+	n.calls[method]++
+	latency := n.latency
+	var err error
+	for i, f := range n.failures {
+		if f.method == "" || f.method == method {
+			err = f.err
+			if f.count--; f.count <= 0 {
+				n.failures = append(n.failures[:i], n.failures[i+1:]...)
+			}
+			break
+		}
+	}
+	n.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// mines a block on the head, or the genesis block. txs are used if set,
+// otherwise Config.Txs. Must be called with mu held.
+func (n *Node) mine(txs []Tx) *block {
+	var (
+		number     uint64
+		parentHash = "0x" + fmt.Sprintf("%064x", 0)
+	)
+	if len(n.chain) > 0 {
+		parent := n.chain[len(n.chain)-1]
+		number = uint64(len(n.chain))
+		parentHash = parent.raw.Hash
+	}
+	if txs == nil && n.cfg.Txs != nil {
+		txs = n.cfg.Txs(number)
+	}
+	timestamp := time.Unix(int64(number)*int64(BlockTime/time.Second), 0)
+	if n.cfg.Now != nil {
+		timestamp = n.cfg.Now()
+	}
+
+	hash := keccak(parentHash, number, n.forks)
+	b := &block{raw: common.RawBlock{
+		Hash:             hash,
+		Number:           util.EncodeUint64(number),
+		Timestamp:        util.EncodeUint64(uint64(timestamp.Unix())),
+		Transactions:     make([]common.RawTransaction, len(txs)),
+		ParentHash:       parentHash,
+		Sha3Uncles:       emptyHash,
+		Miner:            emptyAddress,
+		MixHash:          emptyHash,
+		Difficulty:       "0x0",
+		TotalDifficulty:  "0x0",
+		Size:             util.EncodeUint64(542),
+		GasLimit:         util.EncodeUint64(30000000),
+		Nonce:            "0x0000000000000000",
+		Uncles:           []string{},
+		BaseFeePerGas:    util.EncodeUint64(1000000000),
+		ExtraData:        "0x",
+		LogsBloom:        emptyBloom,
+		ReceiptsRoot:     emptyHash,
+		StateRoot:        emptyHash,
+		TransactionsRoot: emptyHash,
+	}, receipts: make([]common.RawTransactionReceipt, len(txs))}
+
+	var (
+		gasUsed, logIndex uint64
+		blockBloom        types.Bloom
+		consensus         = make(types.Receipts, len(txs)) // for the receipts root
+	)
+	for i, tx := range txs {
+		index := util.EncodeUint64(uint64(i))
+		txHash := keccak(hash, uint64(i), 0)
+		gas := tx.Gas
+		if gas == 0 {
+			gas = txGas
+		}
+		b.raw.Transactions[i] = common.RawTransaction{
+			BlockHash:        hash,
+			BlockNumber:      b.raw.Number,
+			From:             tx.From,
+			Gas:              util.EncodeUint64(gas),
+			GasPrice:         b.raw.BaseFeePerGas,
+			Hash:             txHash,
+			Input:            tx.Input,
+			Nonce:            util.EncodeUint64(number),
+			To:               tx.To,
+			TransactionIndex: index,
+			Value:            util.EncodeUint64(tx.Value),
+			Type:             "0x0",
+			ChainId:          "0x1",
+			V:                "0x25",
+			R:                "0x1",
+			S:                "0x1",
+		}
+		if b.raw.Transactions[i].Input == "" {
+			b.raw.Transactions[i].Input = "0x"
+		}
+		gasUsed += gas
+		receipt := common.RawTransactionReceipt{
+			BlockHash:         hash,
+			BlockNumber:       b.raw.Number,
+			CumulativeGasUsed: util.EncodeUint64(gasUsed),
+			From:              tx.From,
+			EffectiveGasPrice: b.raw.BaseFeePerGas,
+			GasUsed:           util.EncodeUint64(gas),
+			Logs:              make([]common.RawLog, len(tx.Logs)),
+			LogsBloom:         emptyBloom,
+			Status:            "0x1",
+			To:                tx.To,
+			TransactionHash:   txHash,
+			TransactionIndex:  index,
+			Type:              "0x0",
+		}
+		var bloom types.Bloom
+		consensus[i] = &types.Receipt{Type: types.LegacyTxType, Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: gasUsed}
+		for j, l := range tx.Logs {
+			receipt.Logs[j] = common.RawLog{
+				Address:          l.Address,
+				Topics:           l.Topics,
+				Data:             l.Data,
+				BlockNumber:      b.raw.Number,
+				TransactionIndex: index,
+				TransactionHash:  txHash,
+				BlockHash:        hash,
+				LogIndex:         util.EncodeUint64(logIndex),
+			}
+			if receipt.Logs[j].Data == "" {
+				receipt.Logs[j].Data = "0x"
+			}
+			logIndex++
+			log := &types.Log{Address: ethcommon.HexToAddress(l.Address), Data: ethcommon.FromHex(l.Data)}
+			for _, topic := range l.Topics {
+				log.Topics = append(log.Topics, ethcommon.HexToHash(topic))
+			}
+			consensus[i].Logs = append(consensus[i].Logs, log)
+			for _, b := range []*types.Bloom{&bloom, &blockBloom} {
+				b.Add(ethcommon.HexToAddress(l.Address).Bytes())
+				for _, topic := range l.Topics {
+					b.Add(ethcommon.HexToHash(topic).Bytes())
+				}
+			}
+		}
+		receipt.LogsBloom = fmt.Sprintf("0x%x", bloom[:])
+		consensus[i].Bloom = bloom
+		b.receipts[i] = receipt
+		n.txs[txHash] = b
+	}
+	b.raw.GasUsed = util.EncodeUint64(gasUsed)
+	b.raw.LogsBloom = fmt.Sprintf("0x%x", blockBloom[:])
+	b.raw.ReceiptsRoot = types.DeriveSha(consensus, trie.NewStackTrie(nil)).Hex()
+
+	n.chain = append(n.chain, b)
+	n.byHash[hash] = b
+	return b
+}
+
+// gas used by a transaction if Tx.Gas is 0
+const txGas = 21000
+
+var (
+	emptyHash    = "0x" + fmt.Sprintf("%064x", 0)
+	emptyAddress = "0x" + fmt.Sprintf("%040x", 0)
+	emptyBloom   = "0x" + fmt.Sprintf("%0512x", 0)
+)
+
+// returns a deterministic hash of a block or transaction
+func keccak(parent string, number uint64, salt uint64) string {
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(parent))
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], number)
+	binary.BigEndian.PutUint64(buf[8:], salt)
+	h.Write(buf[:])
+	return fmt.Sprintf("0x%x", h.Sum(nil))
+}
@@ -0,0 +1,240 @@
+package fakenode
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iquidus/blockspider/common"
+)
+
+const (
+	token    = "0xdac17f958d2ee523a2206206994597c13d831ec7"
+	transfer = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+)
+
+func newTestClient(t *testing.T, n *Node) *common.RPCClient {
+	ts := httptest.NewServer(n.Handler())
+	t.Cleanup(ts.Close)
+	client, err := common.NewRPCClient(&common.RPCConfig{
+		Type:     "http",
+		Endpoint: ts.URL,
+		Retry:    common.RetryConfig{MinBackoff: "1ms", MaxBackoff: "5ms", Timeout: "1s"},
+	})
+	if err != nil {
+		t.Fatal("Error creating rpc client: ", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestMineReorg(t *testing.T) {
+	n := New(&Config{})
+	client := newTestClient(t, n)
+	ctx := context.Background()
+	n.Mine(10)
+
+	head, err := client.LatestBlockNumber(ctx)
+	if err != nil || head != 10 {
+		t.Fatalf("TestMineReorg head = %d, %v; want 10", head, err)
+	}
+	old, err := client.GetBlockByHeight(ctx, 8)
+	if err != nil {
+		t.Fatal("Error getting block: ", err)
+	}
+	parent, _ := n.Block(7)
+	if old.ParentHash != parent.Hash {
+		t.Errorf("TestMineReorg parent = %s; want %s", old.ParentHash, parent.Hash)
+	}
+
+	if err = n.Reorg(3); err != nil {
+		t.Fatal("Error reorging: ", err)
+	}
+	replaced, err := client.GetBlockByHeight(ctx, 8)
+	if err != nil {
+		t.Fatal("Error getting block: ", err)
+	}
+	if replaced.Hash == old.Hash || replaced.ParentHash != parent.Hash {
+		t.Errorf("TestMineReorg block 8 = %s on %s; want new block on %s", replaced.Hash, replaced.ParentHash, parent.Hash)
+	}
+	// replaced blocks are still served by hash
+	if b, err := client.GetBlockByHash(ctx, old.Hash); err != nil || b.Hash != old.Hash {
+		t.Errorf("TestMineReorg replaced by hash = %s, %v; want %s", b.Hash, err, old.Hash)
+	}
+	if err = n.Reorg(11); err == nil {
+		t.Error("TestMineReorg past genesis err = nil; want error")
+	}
+
+	// hashes are deterministic
+	other := New(&Config{})
+	other.Mine(10)
+	if err = other.Reorg(3); err != nil {
+		t.Fatal("Error reorging: ", err)
+	}
+	if h := other.Head(); h.Hash != n.Head().Hash {
+		t.Errorf("TestMineReorg head = %s; want %s", h.Hash, n.Head().Hash)
+	}
+}
+
+func TestReceiptsLogs(t *testing.T) {
+	n := New(&Config{Txs: func(number uint64) []Tx {
+		return []Tx{
+			{From: "0x01", To: "0x02", Value: number},
+			{From: "0x01", To: token, Gas: 50000, Logs: []Log{{Address: token, Topics: []string{transfer}}}},
+		}
+	}})
+	client := newTestClient(t, n)
+	ctx := context.Background()
+	n.Mine(2)
+
+	raw, err := client.GetBlockByHeight(ctx, 2)
+	if err != nil {
+		t.Fatal("Error getting block: ", err)
+	}
+	for _, blockReceipts := range []bool{false, true} {
+		if blockReceipts {
+			if ok, err := client.ProbeBlockReceipts(ctx); !ok || err != nil {
+				t.Fatalf("TestReceiptsLogs probe = %v, %v; want supported", ok, err)
+			}
+		}
+		block, err := client.ConvertBlock(ctx, &raw)
+		if err != nil {
+			t.Fatal("Error converting block: ", err)
+		}
+		if len(block.Transactions) != 2 || len(block.Logs) != 1 || block.Logs[0].Transaction.Hash != raw.Transactions[1].Hash {
+			t.Errorf("TestReceiptsLogs block = %d txns, %d logs; want 2, 1", len(block.Transactions), len(block.Logs))
+		}
+	}
+
+	receipts := n.Receipts(2)
+	if receipts[0].LogsBloom != emptyBloom || receipts[1].LogsBloom == emptyBloom || raw.LogsBloom != receipts[1].LogsBloom {
+		t.Errorf("TestReceiptsLogs blooms = %s, %s; want the log's bloom on the block and its receipt", raw.LogsBloom, receipts[1].LogsBloom)
+	}
+	if receipts[1].GasUsed != "0xc350" || raw.GasUsed != "0x11558" {
+		t.Errorf("TestReceiptsLogs gas used = %s, %s; want 0xc350, 0x11558", receipts[1].GasUsed, raw.GasUsed)
+	}
+	if err := raw.VerifyReceipts(receipts); err != nil {
+		t.Error("TestReceiptsLogs receipts root: ", err)
+	}
+
+	logs, err := client.GetLogs(ctx, []string{token}, raw.Hash, []string{transfer})
+	if err != nil || len(logs) != 1 || logs[0].BlockHash != raw.Hash {
+		t.Errorf("TestReceiptsLogs logs = %+v, %v; want 1", logs, err)
+	}
+	if logs, _ = client.GetLogs(ctx, []string{"0x02"}, raw.Hash, nil); len(logs) != 0 {
+		t.Errorf("TestReceiptsLogs other address logs = %d; want 0", len(logs))
+	}
+
+	// transactions of replaced blocks have no receipt
+	if err = n.Reorg(1); err != nil {
+		t.Fatal("Error reorging: ", err)
+	}
+	if _, err = client.GetTransactionReceipts(ctx, []string{raw.Transactions[0].Hash}); err == nil {
+		t.Error("TestReceiptsLogs replaced receipt err = nil; want error")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	n := New(&Config{})
+	client := newTestClient(t, n)
+	ctx := context.Background()
+	n.Mine(5)
+
+	// json-rpc and http errors are retried by the client
+	n.Fail("eth_getBlockByNumber", 2, ErrLimitExceeded)
+	if _, err := client.GetBlockByHeight(ctx, 5); err != nil {
+		t.Errorf("TestFaults rate limited err = %v; want nil", err)
+	}
+	if calls := n.Calls("eth_getBlockByNumber"); calls != 3 {
+		t.Errorf("TestFaults calls = %d; want 3", calls)
+	}
+	n.FailHTTP(http.StatusServiceUnavailable, 2)
+	if _, err := client.Ping(ctx); err != nil {
+		t.Errorf("TestFaults unavailable err = %v; want nil", err)
+	}
+	n.Fail("", 1, &Error{-32000, "internal error"})
+	if _, err := client.Ping(ctx); err == nil {
+		t.Error("TestFaults internal error err = nil; want error")
+	}
+
+	// reports a head it can't serve yet
+	n.SetLag(2)
+	head, err := client.LatestBlockNumber(ctx)
+	if err != nil || head != 7 {
+		t.Errorf("TestFaults lagging head = %d, %v; want 7", head, err)
+	}
+	if _, err = client.GetBlockByHeight(ctx, head); !errors.Is(err, common.ErrBlockNotFound) {
+		t.Errorf("TestFaults lagging err = %v; want %v", err, common.ErrBlockNotFound)
+	}
+
+	n.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	if _, err = client.Ping(ctx); err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("TestFaults latency = %v, %v; want >= 50ms", time.Since(start), err)
+	}
+
+	if _, _, err = client.GetBlockByTag(ctx, "finalized"); err == nil {
+		t.Error("TestFaults finalized err = nil; want unknown block")
+	}
+	n.Finalize(3)
+	if number, _, err := client.GetBlockByTag(ctx, "finalized"); err != nil || number != 3 {
+		t.Errorf("TestFaults finalized = %d, %v; want 3", number, err)
+	}
+}
+
+func TestLaggingReceipts(t *testing.T) {
+	txs := func(number uint64) []Tx {
+		return []Tx{{From: "0x01", To: "0x02", Value: number}}
+	}
+	// both nodes report block 5, the faster one doesn't have it yet
+	lagging, synced := New(&Config{Txs: txs}), New(&Config{Txs: txs})
+	lagging.Mine(4)
+	lagging.SetLag(1)
+	synced.Mine(5)
+	synced.SetLatency(20 * time.Millisecond)
+	primary, fallback := httptest.NewServer(lagging.Handler()), httptest.NewServer(synced.Handler())
+	t.Cleanup(primary.Close)
+	t.Cleanup(fallback.Close)
+	newClient := func() *common.RPCClient {
+		client, err := common.NewRPCClient(&common.RPCConfig{
+			Type:     "http",
+			Endpoint: primary.URL,
+			Nodes:    []common.RPCConfig{{Type: "http", Endpoint: fallback.URL}},
+			Retry:    common.RetryConfig{MinBackoff: "1ms", MaxBackoff: "5ms", Timeout: "1s"},
+		})
+		if err != nil {
+			t.Fatal("Error creating rpc client: ", err)
+		}
+		t.Cleanup(client.Close)
+		return client
+	}
+	ctx := context.Background()
+
+	raw, _ := synced.Block(5)
+	for _, blockReceipts := range []bool{false, true} {
+		client := newClient()
+		if _, err := client.LatestBlockNumber(ctx); err != nil {
+			t.Fatal("Error polling heads: ", err)
+		}
+		if blockReceipts {
+			if ok, err := client.ProbeBlockReceipts(ctx); !ok || err != nil {
+				t.Fatalf("TestLaggingReceipts probe = %v, %v; want supported", ok, err)
+			}
+		}
+		// null receipts fail over to the node that has the block
+		block, err := client.ConvertBlock(ctx, &raw)
+		if err != nil || len(block.Transactions) != 1 {
+			t.Errorf("TestLaggingReceipts(blockReceipts=%v) err = %v; want receipts from the fallback", blockReceipts, err)
+		}
+	}
+
+	// no node has the block
+	lagging.Reorg(1)
+	synced.Reorg(1)
+	if _, err := newClient().GetTransactionReceipts(ctx, raw.TransactionHashes()); !errors.Is(err, common.ErrBlockNotFound) {
+		t.Errorf("TestLaggingReceipts err = %v; want %v", err, common.ErrBlockNotFound)
+	}
+}
@@ -0,0 +1,251 @@
+package fakenode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/util"
+)
+
+// service implements the json-rpc methods, registered as the eth and web3
+// namespaces
+type service struct {
+	n *Node
+}
+
+// a block with transaction hashes, as returned when full is false
+type headerBlock struct {
+	common.RawBlock
+	Transactions []string `json:"transactions"`
+}
+
+// LogFilter is the eth_getLogs filter, either a block hash or a range
+type LogFilter struct {
+	BlockHash string            `json:"blockHash"`
+	FromBlock string            `json:"fromBlock"`
+	ToBlock   string            `json:"toBlock"`
+	Address   addresses         `json:"address"`
+	Topics    []json.RawMessage `json:"topics"`
+}
+
+// addresses is a single address or a list
+type addresses []string
+
+func (a *addresses) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = addresses{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (s *service) ClientVersion(ctx context.Context) (string, error) {
+	if err := s.n.enter(ctx, "web3_clientVersion"); err != nil {
+		return "", err
+	}
+	return ClientVersion, nil
+}
+
+func (s *service) BlockNumber(ctx context.Context) (string, error) {
+	if err := s.n.enter(ctx, "eth_blockNumber"); err != nil {
+		return "", err
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	return util.EncodeUint64(uint64(len(s.n.chain)-1) + s.n.lag), nil
+}
+
+func (s *service) GetBlockByNumber(ctx context.Context, number string, full bool) (interface{}, error) {
+	if err := s.n.enter(ctx, "eth_getBlockByNumber"); err != nil {
+		return nil, err
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	b, err := s.n.byNumber(number)
+	if b == nil || err != nil {
+		return nil, err
+	}
+	return b.marshal(full), nil
+}
+
+func (s *service) GetBlockByHash(ctx context.Context, hash string, full bool) (interface{}, error) {
+	if err := s.n.enter(ctx, "eth_getBlockByHash"); err != nil {
+		return nil, err
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	b, ok := s.n.byHash[hash]
+	if !ok {
+		return nil, nil
+	}
+	return b.marshal(full), nil
+}
+
+func (s *service) GetTransactionReceipt(ctx context.Context, hash string) (*common.RawTransactionReceipt, error) {
+	if err := s.n.enter(ctx, "eth_getTransactionReceipt"); err != nil {
+		return nil, err
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	b, ok := s.n.txs[hash]
+	if !ok {
+		return nil, nil
+	}
+	for i := range b.receipts {
+		if b.receipts[i].TransactionHash == hash {
+			return &b.receipts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// GetBlockReceipts takes a block hash, number or tag
+func (s *service) GetBlockReceipts(ctx context.Context, id string) ([]common.RawTransactionReceipt, error) {
+	if err := s.n.enter(ctx, "eth_getBlockReceipts"); err != nil {
+		return nil, err
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+	b, ok := s.n.byHash[id]
+	if !ok && len(id) == len(emptyHash) {
+		// an unknown block hash
+		return nil, nil
+	}
+	if !ok {
+		var err error
+		if b, err = s.n.byNumber(id); b == nil || err != nil {
+			return nil, err
+		}
+	}
+	return b.receipts, nil
+}
+
+func (s *service) GetLogs(ctx context.Context, filter LogFilter) ([]common.RawLog, error) {
+	if err := s.n.enter(ctx, "eth_getLogs"); err != nil {
+		return nil, err
+	}
+	topics, err := parseTopics(filter.Topics)
+	if err != nil {
+		return nil, err
+	}
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+
+	var blocks []*block
+	if filter.BlockHash != "" {
+		if b, ok := s.n.byHash[filter.BlockHash]; ok {
+			blocks = append(blocks, b)
+		}
+	} else {
+		from, err := s.n.byNumber(filter.FromBlock)
+		if err != nil {
+			return nil, err
+		}
+		to, err := s.n.byNumber(filter.ToBlock)
+		if err != nil {
+			return nil, err
+		}
+		if from != nil && to != nil {
+			first, last := util.DecodeHex(from.raw.Number), util.DecodeHex(to.raw.Number)
+			for i := first; i <= last; i++ {
+				blocks = append(blocks, s.n.chain[i])
+			}
+		}
+	}
+
+	logs := []common.RawLog{}
+	for _, b := range blocks {
+		for _, r := range b.receipts {
+			for _, l := range r.Logs {
+				if matchLog(&l, filter.Address, topics) {
+					logs = append(logs, l)
+				}
+			}
+		}
+	}
+	return logs, nil
+}
+
+// returns the canonical block with a hex number or tag, an empty number is
+// the head. Must be called with mu held.
+func (n *Node) byNumber(number string) (*block, error) {
+	switch number {
+	case "", "latest", "pending":
+		return n.chain[len(n.chain)-1], nil
+	case "earliest":
+		return n.chain[0], nil
+	case "safe", "finalized":
+		if n.finalized == nil {
+			return nil, &Error{unknownBlockCode, "Unknown block"}
+		}
+		return n.chain[*n.finalized], nil
+	}
+	if !strings.HasPrefix(number, "0x") {
+		return nil, fmt.Errorf("invalid block number %q", number)
+	}
+	i := util.DecodeHex(number)
+	if i >= uint64(len(n.chain)) {
+		return nil, nil
+	}
+	return n.chain[i], nil
+}
+
+// returns the block to serve, with full transactions or their hashes
+func (b *block) marshal(full bool) interface{} {
+	if full {
+		return &b.raw
+	}
+	hb := &headerBlock{RawBlock: b.raw, Transactions: make([]string, len(b.raw.Transactions))}
+	for i, tx := range b.raw.Transactions {
+		hb.Transactions[i] = tx.Hash
+	}
+	return hb
+}
+
+// parses log filter topics, each position is null (any), a topic or a list
+// of topics
+func parseTopics(raw []json.RawMessage) ([][]string, error) {
+	topics := make([][]string, len(raw))
+	for i, r := range raw {
+		if string(r) == "null" {
+			continue
+		}
+		var one string
+		if err := json.Unmarshal(r, &one); err == nil {
+			topics[i] = []string{one}
+			continue
+		}
+		if err := json.Unmarshal(r, &topics[i]); err != nil {
+			return nil, fmt.Errorf("invalid topic %d: %w", i, err)
+		}
+	}
+	return topics, nil
+}
+
+func matchLog(l *common.RawLog, addresses []string, topics [][]string) bool {
+	if len(addresses) > 0 && !contains(addresses, l.Address) {
+		return false
+	}
+	for i, want := range topics {
+		if len(want) == 0 {
+			continue
+		}
+		if i >= len(l.Topics) || !contains(want, l.Topics[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
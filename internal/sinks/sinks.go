@@ -0,0 +1,51 @@
+// Package sinks creates the block sinks configured for a daemon.
+package sinks
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/nats"
+	"github.com/iquidus/blockspider/params"
+	"github.com/iquidus/blockspider/sink"
+	"github.com/iquidus/blockspider/storage"
+)
+
+var ErrNoSinks = errors.New("no sinks configured")
+
+// New creates a sink for each configured output. store may be nil if no
+// storage backend is configured.
+func New(cfg *params.Config, store *storage.Store) (sink.Sink, error) {
+	var sinks sink.Multi
+	if store != nil {
+		sinks = append(sinks, store)
+		log.Info("writing blocks to storage", "driver", cfg.Storage.Driver)
+	}
+	if cfg.Kafka.Broker != "" {
+		kw := kafka.NewWriter(cfg.Kafka.Broker, cfg.Kafka.Params, 1)
+		kw.ReorgTopic = cfg.Kafka.ReorgTopic
+		sinks = append(sinks, kw)
+		log.Info("writing blocks to kafka", "broker", cfg.Kafka.Broker)
+	}
+	if cfg.Nats.Url != "" {
+		nw, err := nats.NewWriter(&cfg.Nats)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, nw)
+		log.Info("writing blocks to nats", "url", cfg.Nats.Url)
+	}
+	if len(sinks) == 0 {
+		return nil, ErrNoSinks
+	}
+	return sinks, nil
+}
+
+// OpenStorage opens the configured storage backend, returns nil if none is configured
+func OpenStorage(cfg *params.Config) (*storage.Store, error) {
+	if cfg.Storage.Dsn == "" {
+		return nil, nil
+	}
+	return storage.New(&cfg.Storage)
+}
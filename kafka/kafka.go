@@ -2,6 +2,15 @@ package kafka
 
 import "github.com/iquidus/blockspider/common"
 
+// payload statuses
+const (
+	StatusAccepted  = "ACCEPTED"
+	StatusDropped   = "DROPPED"
+	StatusConfirmed = "CONFIRMED" // past the confirmation depth
+	StatusFinalized = "FINALIZED" // at or below the node's safe/finalized block
+	StatusReorg     = "REORG"     // a chain reorg, see ReorgPayload
+)
+
 type TopicParams struct {
 	Topic     string   `json:"topic"`
 	Addresses []string `json:"addresses"`
@@ -9,8 +18,9 @@ type TopicParams struct {
 }
 
 type Config struct {
-	Broker string        `json:"broker"`
-	Params []TopicParams `json:"params"`
+	Broker     string        `json:"broker"`
+	Params     []TopicParams `json:"params"`
+	ReorgTopic string        `json:"reorgTopic"` // topic for reorg payloads, not written if empty
 }
 
 type Payload struct {
@@ -18,3 +28,11 @@ type Payload struct {
 	Block   common.Block `json:"block"`
 	Version int          `json:"version"`
 }
+
+// ReorgPayload is written once per reorg, after the DROPPED and ACCEPTED
+// payloads of the blocks it replaced
+type ReorgPayload struct {
+	Status  string       `json:"status"` // always StatusReorg
+	Reorg   common.Reorg `json:"reorg"`
+	Version int          `json:"version"`
+}
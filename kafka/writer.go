@@ -2,13 +2,22 @@ package kafka
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
+	"time"
 
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/metrics"
+	"github.com/iquidus/blockspider/sink"
 	"github.com/segmentio/kafka-go"
 )
 
+var _ sink.Sink = (*Writer)(nil)
+
 type Writer struct {
-	Writer *kafka.Writer
-	Params *[]TopicParams
+	Writer     *kafka.Writer
+	Params     *[]TopicParams
+	ReorgTopic string // reorgs aren't written if empty
 }
 
 func NewWriter(broker string, params []TopicParams, batchSize int) *Writer {
@@ -26,5 +35,104 @@ func NewWriter(broker string, params []TopicParams, batchSize int) *Writer {
 }
 
 func (w *Writer) WriteMessages(ctx context.Context, payload []byte, topic string) error {
-	return w.Writer.WriteMessages(ctx, kafka.Message{Value: payload, Topic: topic})
+	return w.write(ctx, kafka.Message{Value: payload, Topic: topic})
+}
+
+// writes a message, recording the write latency and outcome for its topic
+func (w *Writer) write(ctx context.Context, msg kafka.Message) error {
+	start := time.Now()
+	err := w.Writer.WriteMessages(ctx, msg)
+	metrics.ObserveKafkaWrite(msg.Topic, start, err)
+	return err
+}
+
+// MsgKey returns the message key for a block payload. Blocks may be written
+// more than once (e.g: redelivered from the outbox after a restart), consumers
+// can use the key to drop duplicates. The outbox sequence tells a redelivery
+// apart from a block accepted again after flip-flopping reorgs.
+func MsgKey(status string, block *common.Block, seq uint64) []byte {
+	return []byte(block.Hash + ":" + status + ":" + strconv.FormatUint(seq, 10))
+}
+
+// Accept writes an ACCEPTED payload for block to each configured topic
+func (w *Writer) Accept(ctx context.Context, block *common.Block) error {
+	return w.writePayloads(ctx, StatusAccepted, block)
+}
+
+// Drop writes a DROPPED payload for block to each configured topic
+func (w *Writer) Drop(ctx context.Context, block *common.Block) error {
+	return w.writePayloads(ctx, StatusDropped, block)
+}
+
+// Confirm writes a CONFIRMED payload for block to each configured topic
+func (w *Writer) Confirm(ctx context.Context, block *common.Block) error {
+	return w.writePayloads(ctx, StatusConfirmed, block)
+}
+
+// Finalize writes a FINALIZED payload for block to each configured topic
+func (w *Writer) Finalize(ctx context.Context, block *common.Block) error {
+	return w.writePayloads(ctx, StatusFinalized, block)
+}
+
+// ReorgKey returns the message key for a reorg payload, consumers can use it
+// to drop duplicates. Like MsgKey it includes the outbox sequence, the same
+// reorg may happen more than once.
+func ReorgKey(reorg *common.Reorg, seq uint64) []byte {
+	return []byte(reorg.Ancestor.Hash + ":" + reorg.Head() + ":" + StatusReorg + ":" + strconv.FormatUint(seq, 10))
+}
+
+// Reorg writes a REORG payload to the reorg topic
+func (w *Writer) Reorg(ctx context.Context, reorg *common.Reorg) error {
+	if w.ReorgTopic == "" {
+		return nil
+	}
+	payload, err := json.Marshal(ReorgPayload{
+		Status:  StatusReorg,
+		Reorg:   *reorg,
+		Version: 1,
+	})
+	if err != nil {
+		return err
+	}
+	return w.write(ctx, kafka.Message{
+		Key:   ReorgKey(reorg, sink.Seq(ctx)),
+		Value: payload,
+		Topic: w.ReorgTopic,
+	})
+}
+
+// Flush is a no-op, WriteMessages blocks until messages are written
+func (w *Writer) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (w *Writer) Close() error {
+	return w.Writer.Close()
+}
+
+// writes a payload to each topic, with logs filtered by the topic params
+func (w *Writer) writePayloads(ctx context.Context, status string, block *common.Block) error {
+	for _, ktopic := range *w.Params {
+		// copy block so filtering doesn't modify the original
+		nb := *block
+		nb.Logs = common.FilterLogs(block.Logs, ktopic.Addresses, ktopic.Topics)
+		var bp = Payload{
+			Status:  status,
+			Block:   nb,
+			Version: 1,
+		}
+		payload, err := json.Marshal(bp)
+		if err != nil {
+			return err
+		}
+		err = w.write(ctx, kafka.Message{
+			Key:   MsgKey(status, block, sink.Seq(ctx)),
+			Value: payload,
+			Topic: ktopic.Topic,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,169 @@
+// Package metrics exposes blockspider's prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "blockspider"
+
+// Registry holds all blockspider metrics, along with go and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	LocalHead = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "local_head",
+		Help:      "Number of the cached head block.",
+	})
+	RemoteHead = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "remote_head",
+		Help:      "Latest block number reported by the node.",
+	})
+	Lag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "lag_blocks",
+		Help:      "Number of blocks the cached head is behind the node.",
+	})
+
+	Blocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_processed_total",
+		Help:      "Blocks added to the canonical chain.",
+	})
+	Txns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "txns_processed_total",
+		Help:      "Transactions in processed blocks.",
+	})
+	Logs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logs_processed_total",
+		Help:      "Logs in processed blocks.",
+	})
+
+	Reorgs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reorgs_total",
+		Help:      "Chain reorgs handled.",
+	})
+	ReorgDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reorg_depth_blocks",
+		Help:      "Number of blocks replaced by each reorg.",
+		Buckets:   []float64{1, 2, 3, 5, 8, 13, 21, 34, 64, 128},
+	})
+	DeepReorgs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deep_reorgs_total",
+		Help:      "Chain reorgs deeper than the block cache.",
+	})
+
+	RPCLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of json-rpc calls by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	RPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed json-rpc calls by method.",
+	}, []string{"method"})
+	RPCRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_retries_total",
+		Help:      "Retried json-rpc calls by method.",
+	}, []string{"method"})
+
+	KafkaWriteLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kafka_write_duration_seconds",
+		Help:      "Latency of kafka writes by topic.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"topic"})
+	KafkaWriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_write_failures_total",
+		Help:      "Failed kafka writes by topic.",
+	}, []string{"topic"})
+
+	SyncTasks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_tasks_in_flight",
+		Help:      "Syncronizer tasks currently running.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		LocalHead, RemoteHead, Lag,
+		Blocks, Txns, Logs,
+		Reorgs, ReorgDepth, DeepReorgs,
+		RPCLatency, RPCErrors, RPCRetries,
+		KafkaWriteLatency, KafkaWriteFailures,
+		SyncTasks,
+	)
+}
+
+// heads tracks the last local and remote heads to derive lag
+var heads struct {
+	sync.Mutex
+	local, remote uint64
+}
+
+// SetLocalHead records the cached head and updates lag
+func SetLocalHead(n uint64) {
+	heads.Lock()
+	defer heads.Unlock()
+	heads.local = n
+	LocalHead.Set(float64(n))
+	updateLag()
+}
+
+// SetRemoteHead records the node's head and updates lag
+func SetRemoteHead(n uint64) {
+	heads.Lock()
+	defer heads.Unlock()
+	heads.remote = n
+	RemoteHead.Set(float64(n))
+	updateLag()
+}
+
+func updateLag() {
+	if heads.remote > heads.local {
+		Lag.Set(float64(heads.remote - heads.local))
+	} else {
+		Lag.Set(0)
+	}
+}
+
+// ObserveRPC records the latency and outcome of a json-rpc call
+func ObserveRPC(method string, start time.Time, err error) {
+	RPCLatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		RPCErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// ObserveKafkaWrite records the latency and outcome of a kafka write
+func ObserveKafkaWrite(topic string, start time.Time, err error) {
+	KafkaWriteLatency.WithLabelValues(topic).Observe(time.Since(start).Seconds())
+	if err != nil {
+		KafkaWriteFailures.WithLabelValues(topic).Inc()
+	}
+}
+
+// Handler serves the registry in the prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
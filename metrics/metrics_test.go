@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLag(t *testing.T) {
+	SetLocalHead(100)
+	SetRemoteHead(110)
+	if lag := testutil.ToFloat64(Lag); lag != 10 {
+		t.Errorf("TestLag lag = %v; want 10", lag)
+	}
+	// local ahead of a stale remote head is not negative lag
+	SetLocalHead(120)
+	if lag := testutil.ToFloat64(Lag); lag != 0 {
+		t.Errorf("TestLag lag = %v; want 0", lag)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObserveRPC("eth_blockNumber", time.Now(), errors.New("timeout"))
+	ObserveKafkaWrite("blocks", time.Now(), nil)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal("Error reading response: ", err)
+	}
+	for _, want := range []string{
+		`blockspider_rpc_errors_total{method="eth_blockNumber"} 1`,
+		`blockspider_rpc_duration_seconds_count{method="eth_blockNumber"} 1`,
+		`blockspider_kafka_write_duration_seconds_count{topic="blocks"} 1`,
+		`blockspider_lag_blocks`,
+		`blockspider_sync_tasks_in_flight`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("TestHandler missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package nats
+
+// SubjectParams mirrors kafka.TopicParams, publishing blocks to Subject with
+// logs filtered by Addresses and Topics
+type SubjectParams struct {
+	Subject   string   `json:"subject"`
+	Addresses []string `json:"addresses"`
+	Topics    []string `json:"topics"`
+}
+
+type Config struct {
+	Url          string          `json:"url"`
+	Stream       string          `json:"stream"` // if set, stream is created/updated to cover all subjects
+	Params       []SubjectParams `json:"params"`
+	ReorgSubject string          `json:"reorgSubject"` // subject for reorg payloads, not published if empty
+}
@@ -0,0 +1,150 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/sink"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var _ sink.Sink = (*Writer)(nil)
+
+// Writer publishes block payloads to JetStream
+type Writer struct {
+	Conn         *nats.Conn
+	Js           jetstream.JetStream
+	Params       *[]SubjectParams
+	ReorgSubject string // reorgs aren't published if empty
+}
+
+func NewWriter(cfg *Config) (*Writer, error) {
+	nc, err := nats.Connect(cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	params := cfg.Params
+	if cfg.Stream != "" {
+		subjects := make([]string, len(params))
+		for i, p := range params {
+			subjects[i] = p.Subject
+		}
+		if cfg.ReorgSubject != "" {
+			subjects = append(subjects, cfg.ReorgSubject)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     cfg.Stream,
+			Subjects: subjects,
+		})
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return &Writer{
+		Conn:         nc,
+		Js:           js,
+		Params:       &params,
+		ReorgSubject: cfg.ReorgSubject,
+	}, nil
+}
+
+// MsgId returns the JetStream de-duplication id for a block payload.
+// The subject is included as a stream may cover several subjects, and the
+// outbox sequence so a block accepted again after flip-flopping reorgs isn't
+// dropped as a duplicate.
+func MsgId(subject string, status string, block *common.Block, seq uint64) string {
+	return block.Hash + ":" + status + ":" + subject + ":" + strconv.FormatUint(seq, 10)
+}
+
+// Accept publishes an ACCEPTED payload for block to each configured subject
+func (w *Writer) Accept(ctx context.Context, block *common.Block) error {
+	return w.publishPayloads(ctx, kafka.StatusAccepted, block)
+}
+
+// Drop publishes a DROPPED payload for block to each configured subject
+func (w *Writer) Drop(ctx context.Context, block *common.Block) error {
+	return w.publishPayloads(ctx, kafka.StatusDropped, block)
+}
+
+// Confirm publishes a CONFIRMED payload for block to each configured subject
+func (w *Writer) Confirm(ctx context.Context, block *common.Block) error {
+	return w.publishPayloads(ctx, kafka.StatusConfirmed, block)
+}
+
+// Finalize publishes a FINALIZED payload for block to each configured subject
+func (w *Writer) Finalize(ctx context.Context, block *common.Block) error {
+	return w.publishPayloads(ctx, kafka.StatusFinalized, block)
+}
+
+// ReorgMsgId returns the JetStream de-duplication id for a reorg payload,
+// with the outbox sequence as the same reorg may happen more than once
+func ReorgMsgId(reorg *common.Reorg, seq uint64) string {
+	return reorg.Ancestor.Hash + ":" + reorg.Head() + ":" + kafka.StatusReorg + ":" + strconv.FormatUint(seq, 10)
+}
+
+// Reorg publishes a REORG payload to the reorg subject
+func (w *Writer) Reorg(ctx context.Context, reorg *common.Reorg) error {
+	if w.ReorgSubject == "" {
+		return nil
+	}
+	payload, err := json.Marshal(kafka.ReorgPayload{
+		Status:  kafka.StatusReorg,
+		Reorg:   *reorg,
+		Version: 1,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Js.Publish(ctx, w.ReorgSubject, payload, jetstream.WithMsgID(ReorgMsgId(reorg, sink.Seq(ctx))))
+	return err
+}
+
+// Flush flushes the underlying connection, publishes are already acknowledged
+func (w *Writer) Flush(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return w.Conn.Flush()
+	}
+	return w.Conn.FlushWithContext(ctx)
+}
+
+func (w *Writer) Close() error {
+	return w.Conn.Drain()
+}
+
+// publishes a payload to each subject, with logs filtered by the subject params
+func (w *Writer) publishPayloads(ctx context.Context, status string, block *common.Block) error {
+	for _, subject := range *w.Params {
+		// copy block so filtering doesn't modify the original
+		nb := *block
+		nb.Logs = common.FilterLogs(block.Logs, subject.Addresses, subject.Topics)
+		var bp = kafka.Payload{
+			Status:  status,
+			Block:   nb,
+			Version: 1,
+		}
+		payload, err := json.Marshal(bp)
+		if err != nil {
+			return err
+		}
+		_, err = w.Js.Publish(ctx, subject.Subject, payload, jetstream.WithMsgID(MsgId(subject.Subject, status, block, sink.Seq(ctx))))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
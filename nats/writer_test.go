@@ -0,0 +1,217 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/sink"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const testStream = "blocks"
+
+// starts an embedded nats-server with jetstream enabled
+func runServer(t *testing.T) *server.Server {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal("Error creating server: ", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func newTestWriter(t *testing.T) *Writer {
+	ns := runServer(t)
+	w, err := NewWriter(&Config{
+		Url:    ns.ClientURL(),
+		Stream: testStream,
+		Params: []SubjectParams{
+			{Subject: "blocks.all"},
+			{Subject: "blocks.token", Addresses: []string{"0xa"}},
+		},
+		ReorgSubject: "blocks.reorgs",
+	})
+	if err != nil {
+		t.Fatal("Error creating writer: ", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func testBlock() *common.Block {
+	return &common.Block{
+		Number: 1,
+		Hash:   "0x01",
+		Logs: []common.Log{
+			{Address: "0xa"},
+			{Address: "0xb"},
+		},
+	}
+}
+
+func streamMsgs(t *testing.T, w *Writer) uint64 {
+	s, err := w.Js.Stream(context.Background(), testStream)
+	if err != nil {
+		t.Fatal("Error getting stream: ", err)
+	}
+	info, err := s.Info(context.Background())
+	if err != nil {
+		t.Fatal("Error getting stream info: ", err)
+	}
+	return info.State.Msgs
+}
+
+func TestWriterDeduplicates(t *testing.T) {
+	w := newTestWriter(t)
+	ctx := context.Background()
+	block := testBlock()
+
+	// same block accepted twice is only stored once per subject
+	for i := 0; i < 2; i++ {
+		if err := w.Accept(ctx, block); err != nil {
+			t.Fatal("Error accepting block: ", err)
+		}
+	}
+	if got := streamMsgs(t, w); got != 2 {
+		t.Errorf("TestWriterDeduplicates msgs = %d; want 2", got)
+	}
+
+	// dropping the block is a distinct message
+	if err := w.Drop(ctx, block); err != nil {
+		t.Fatal("Error dropping block: ", err)
+	}
+	if err := w.Flush(ctx); err != nil {
+		t.Fatal("Error flushing writer: ", err)
+	}
+	if got := streamMsgs(t, w); got != 4 {
+		t.Errorf("TestWriterDeduplicates msgs = %d; want 4", got)
+	}
+}
+
+func TestWriterFlipFlop(t *testing.T) {
+	w := newTestWriter(t)
+	block := testBlock()
+
+	// A->B->A: the block is accepted, dropped and accepted again
+	for seq, write := range []func(context.Context, *common.Block) error{w.Accept, w.Drop, w.Accept} {
+		if err := write(sink.WithSeq(context.Background(), uint64(seq+1)), block); err != nil {
+			t.Fatal("Error writing block: ", err)
+		}
+	}
+	if got := streamMsgs(t, w); got != 6 {
+		t.Errorf("TestWriterFlipFlop msgs = %d; want 6", got)
+	}
+
+	// redelivering the last message is still dropped
+	if err := w.Accept(sink.WithSeq(context.Background(), 3), block); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	if got := streamMsgs(t, w); got != 6 {
+		t.Errorf("TestWriterFlipFlop redelivered msgs = %d; want 6", got)
+	}
+}
+
+func TestWriterFiltersLogs(t *testing.T) {
+	w := newTestWriter(t)
+	ctx := context.Background()
+	block := testBlock()
+
+	if err := w.Accept(ctx, block); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	// original block is not modified
+	if len(block.Logs) != 2 {
+		t.Errorf("TestWriterFiltersLogs block logs = %d; want 2", len(block.Logs))
+	}
+
+	var tests = []struct {
+		subject string
+		logs    int
+	}{
+		{"blocks.all", 2},
+		{"blocks.token", 1},
+	}
+	s, err := w.Js.Stream(ctx, testStream)
+	if err != nil {
+		t.Fatal("Error getting stream: ", err)
+	}
+	for _, tt := range tests {
+		msg, err := s.GetLastMsgForSubject(ctx, tt.subject)
+		if err != nil {
+			t.Fatal("Error getting message: ", err)
+		}
+		var payload kafka.Payload
+		if err := json.Unmarshal(msg.Data, &payload); err != nil {
+			t.Fatal("Error decoding payload: ", err)
+		}
+		if payload.Status != kafka.StatusAccepted {
+			t.Errorf("TestWriterFiltersLogs %s status = %s; want %s", tt.subject, payload.Status, kafka.StatusAccepted)
+		}
+		if len(payload.Block.Logs) != tt.logs {
+			t.Errorf("TestWriterFiltersLogs %s logs = %d; want %d", tt.subject, len(payload.Block.Logs), tt.logs)
+		}
+		if msg.Header.Get(jetstream.MsgIDHeader) != MsgId(tt.subject, kafka.StatusAccepted, block, 0) {
+			t.Errorf("TestWriterFiltersLogs %s msg id = %s", tt.subject, msg.Header.Get(jetstream.MsgIDHeader))
+		}
+	}
+}
+
+func TestWriterReorg(t *testing.T) {
+	w := newTestWriter(t)
+	ctx := context.Background()
+	reorg := &common.Reorg{
+		Ancestor: common.BlockRef{Number: 1, Hash: "0x01"},
+		Dropped:  []string{"0x02"},
+		Added:    []string{"0x03"},
+		Depth:    1,
+	}
+
+	// published once to the reorg subject only
+	for i := 0; i < 2; i++ {
+		if err := w.Reorg(ctx, reorg); err != nil {
+			t.Fatal("Error publishing reorg: ", err)
+		}
+	}
+	if got := streamMsgs(t, w); got != 1 {
+		t.Errorf("TestWriterReorg msgs = %d; want 1", got)
+	}
+	s, err := w.Js.Stream(ctx, testStream)
+	if err != nil {
+		t.Fatal("Error getting stream: ", err)
+	}
+	msg, err := s.GetLastMsgForSubject(ctx, "blocks.reorgs")
+	if err != nil {
+		t.Fatal("Error getting message: ", err)
+	}
+	var payload kafka.ReorgPayload
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		t.Fatal("Error decoding payload: ", err)
+	}
+	if payload.Status != kafka.StatusReorg || payload.Reorg.Ancestor.Hash != "0x01" || payload.Reorg.Head() != "0x03" {
+		t.Errorf("TestWriterReorg payload = %+v", payload)
+	}
+	// the same reorg again, after flip-flopping back, is a new message
+	if err := w.Reorg(sink.WithSeq(ctx, 2), reorg); err != nil {
+		t.Fatal("Error publishing reorg: ", err)
+	}
+	if got := streamMsgs(t, w); got != 2 {
+		t.Errorf("TestWriterReorg repeated msgs = %d; want 2", got)
+	}
+}
@@ -0,0 +1,164 @@
+// Package outbox delivers block and reorg messages recorded in the state outbox to a
+// sink, retrying until the sink acknowledges them.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/sink"
+	"github.com/iquidus/blockspider/state"
+)
+
+const (
+	batchSize  = 100              // max messages delivered per batch
+	minBackoff = time.Second      // initial retry delay
+	maxBackoff = 64 * time.Second // max retry delay
+)
+
+// Store is the durable message store, implemented by state.State
+type Store interface {
+	Pending(limit int) ([]state.Message, error)
+	Ack(seqs ...uint64) error
+}
+
+// Health reports whether the sink is accepting messages
+type Health struct {
+	Healthy      bool      `json:"healthy"`
+	Error        string    `json:"error,omitempty"` // last delivery error
+	LastDelivery time.Time `json:"lastDelivery"`    // last time messages were acknowledged
+}
+
+type Dispatcher struct {
+	store  Store
+	sink   sink.Sink
+	logger log.Logger
+	notify chan struct{}
+
+	mu     sync.Mutex
+	health Health
+}
+
+func New(store Store, sink sink.Sink, logger log.Logger) *Dispatcher {
+	return &Dispatcher{
+		store:  store,
+		sink:   sink,
+		logger: logger,
+		notify: make(chan struct{}, 1),
+		health: Health{Healthy: true},
+	}
+}
+
+// Health returns the outcome of the last delivery
+func (d *Dispatcher) Health() Health {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.health
+}
+
+// Notify wakes the dispatcher after new messages have been saved
+func (d *Dispatcher) Notify() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers pending messages whenever notified, retrying failed
+// deliveries with exponential backoff, until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	backoff := time.Duration(0)
+	for {
+		var retry <-chan time.Time
+		if err := d.Deliver(ctx); err != nil {
+			if backoff == 0 {
+				backoff = minBackoff
+			} else if backoff < maxBackoff {
+				backoff *= 2
+			}
+			d.logger.Warn("Failed to deliver outbox messages, retrying", "in", backoff, "err", err)
+			retry = time.After(backoff)
+		} else {
+			backoff = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.notify:
+		case <-retry:
+		}
+	}
+}
+
+// Deliver writes all pending messages to the sink in order, acknowledging
+// each batch once the sink has flushed it. Stops at the first failure so
+// messages are never delivered out of order.
+func (d *Dispatcher) Deliver(ctx context.Context) error {
+	err := d.deliver(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.health.Healthy = err == nil
+	d.health.Error = ""
+	if err != nil {
+		d.health.Error = err.Error()
+	}
+	return err
+}
+
+func (d *Dispatcher) deliver(ctx context.Context) error {
+	for {
+		messages, err := d.store.Pending(batchSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		seqs := make([]uint64, 0, len(messages))
+		for i := range messages {
+			if err = d.write(ctx, &messages[i]); err != nil {
+				break
+			}
+			seqs = append(seqs, messages[i].Seq)
+		}
+		if len(seqs) > 0 {
+			if ferr := d.sink.Flush(ctx); ferr != nil {
+				return ferr
+			}
+			if aerr := d.store.Ack(seqs...); aerr != nil {
+				return aerr
+			}
+			d.mu.Lock()
+			d.health.LastDelivery = time.Now()
+			d.mu.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Dispatcher) write(ctx context.Context, m *state.Message) error {
+	ctx = sink.WithSeq(ctx, m.Seq)
+	switch m.Status {
+	case kafka.StatusAccepted:
+		return d.sink.Accept(ctx, &m.Block)
+	case kafka.StatusDropped:
+		return d.sink.Drop(ctx, &m.Block)
+	case kafka.StatusConfirmed:
+		return d.sink.Confirm(ctx, &m.Block)
+	case kafka.StatusFinalized:
+		return d.sink.Finalize(ctx, &m.Block)
+	case kafka.StatusReorg:
+		if m.Reorg == nil {
+			return fmt.Errorf("reorg message %d has no reorg", m.Seq)
+		}
+		return d.sink.Reorg(ctx, m.Reorg)
+	default:
+		return fmt.Errorf("unknown message status: %s", m.Status)
+	}
+}
@@ -0,0 +1,195 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/sink"
+	"github.com/iquidus/blockspider/state"
+)
+
+// testSink records delivered messages, failing once on the given hash
+type testSink struct {
+	failOn    string
+	delivered []string
+	seqs      []uint64 // outbox sequence of each delivered message
+	flushes   int
+}
+
+func (s *testSink) write(ctx context.Context, status string, block *common.Block) error {
+	if block.Hash == s.failOn {
+		s.failOn = ""
+		return errors.New("sink unavailable")
+	}
+	s.delivered = append(s.delivered, status+":"+block.Hash)
+	s.seqs = append(s.seqs, sink.Seq(ctx))
+	return nil
+}
+
+func (s *testSink) Accept(ctx context.Context, block *common.Block) error {
+	return s.write(ctx, kafka.StatusAccepted, block)
+}
+
+func (s *testSink) Drop(ctx context.Context, block *common.Block) error {
+	return s.write(ctx, kafka.StatusDropped, block)
+}
+
+func (s *testSink) Confirm(ctx context.Context, block *common.Block) error {
+	return s.write(ctx, kafka.StatusConfirmed, block)
+}
+
+func (s *testSink) Finalize(ctx context.Context, block *common.Block) error {
+	return s.write(ctx, kafka.StatusFinalized, block)
+}
+
+func (s *testSink) Reorg(ctx context.Context, reorg *common.Reorg) error {
+	s.delivered = append(s.delivered, kafka.StatusReorg+":"+reorg.Head())
+	s.seqs = append(s.seqs, sink.Seq(ctx))
+	return nil
+}
+
+func (s *testSink) Flush(ctx context.Context) error {
+	s.flushes++
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func newTestState(t *testing.T) *state.State {
+	chainId := uint64(8)
+	s, err := state.Init(&state.Config{Path: filepath.Join(t.TempDir(), "state.db"), CacheLimit: 8}, &chainId)
+	if err != nil {
+		t.Fatal("Error initializing state: ", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDeliverRetries(t *testing.T) {
+	s := newTestState(t)
+	s.Stage(kafka.StatusAccepted, common.Block{Number: 1, Hash: "a"})
+	s.Stage(kafka.StatusAccepted, common.Block{Number: 2, Hash: "b"})
+	s.Stage(kafka.StatusDropped, common.Block{Number: 2, Hash: "b"})
+
+	// nothing is pending until saved
+	if pending, _ := s.Pending(10); len(pending) != 0 {
+		t.Fatalf("TestDeliverRetries pending = %d; want 0", len(pending))
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+
+	out := &testSink{failOn: "b"}
+	d := New(s, out, log.New())
+	if err := d.Deliver(context.Background()); err == nil {
+		t.Fatal("TestDeliverRetries err = nil; want error")
+	}
+	if h := d.Health(); h.Healthy || h.Error == "" {
+		t.Errorf("TestDeliverRetries health = %+v; want unhealthy", h)
+	}
+	// first message was acknowledged, the rest are kept
+	pending, err := s.Pending(10)
+	if err != nil {
+		t.Fatal("Error reading outbox: ", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("TestDeliverRetries pending = %d; want 2", len(pending))
+	}
+
+	if err := d.Deliver(context.Background()); err != nil {
+		t.Fatal("Error delivering: ", err)
+	}
+	want := []string{"ACCEPTED:a", "ACCEPTED:b", "DROPPED:b"}
+	if len(out.delivered) != len(want) {
+		t.Fatalf("TestDeliverRetries delivered = %v; want %v", out.delivered, want)
+	}
+	for i := range want {
+		if out.delivered[i] != want[i] {
+			t.Errorf("TestDeliverRetries delivered[%d] = %s; want %s", i, out.delivered[i], want[i])
+		}
+	}
+	if pending, _ = s.Pending(10); len(pending) != 0 {
+		t.Errorf("TestDeliverRetries pending = %d; want 0", len(pending))
+	}
+	// the retried message keeps its sequence
+	if fmt.Sprint(out.seqs) != "[1 2 3]" {
+		t.Errorf("TestDeliverRetries seqs = %v; want [1 2 3]", out.seqs)
+	}
+	if out.flushes == 0 {
+		t.Error("TestDeliverRetries sink was not flushed")
+	}
+	if h := d.Health(); !h.Healthy || h.LastDelivery.IsZero() {
+		t.Errorf("TestDeliverRetries health = %+v; want healthy", h)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	chainId := uint64(8)
+	cfg := &state.Config{Path: path, CacheLimit: 8}
+	s, err := state.Init(cfg, &chainId)
+	if err != nil {
+		t.Fatal("Error initializing state: ", err)
+	}
+	block := common.Block{Number: 1, Hash: "a"}
+	s.Stage(kafka.StatusAccepted, block)
+	s.Cache.Push(block)
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	s.Close()
+
+	// message and cursor were committed together
+	s, err = state.Init(cfg, &chainId)
+	if err != nil {
+		t.Fatal("Error initializing state: ", err)
+	}
+	defer s.Close()
+	if head, _ := s.Cache.Peak(); head.Hash != "a" {
+		t.Errorf("TestOutboxSurvivesRestart head = %s; want a", head.Hash)
+	}
+	out := &testSink{}
+	if err := New(s, out, log.New()).Deliver(context.Background()); err != nil {
+		t.Fatal("Error delivering: ", err)
+	}
+	if len(out.delivered) != 1 || out.delivered[0] != "ACCEPTED:a" {
+		t.Errorf("TestOutboxSurvivesRestart delivered = %v", out.delivered)
+	}
+}
+
+func TestDeliverReorg(t *testing.T) {
+	s := newTestState(t)
+	s.Stage(kafka.StatusDropped, common.Block{Number: 2, Hash: "b"})
+	s.Stage(kafka.StatusAccepted, common.Block{Number: 2, Hash: "c"})
+	s.StageReorg(kafka.StatusReorg, common.Reorg{
+		Ancestor: common.BlockRef{Number: 1, Hash: "a"},
+		Dropped:  []string{"b"},
+		Added:    []string{"c"},
+		Depth:    1,
+	})
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+
+	out := &testSink{}
+	if err := New(s, out, log.New()).Deliver(context.Background()); err != nil {
+		t.Fatal("Error delivering: ", err)
+	}
+	want := []string{"DROPPED:b", "ACCEPTED:c", "REORG:c"}
+	if len(out.delivered) != len(want) {
+		t.Fatalf("TestDeliverReorg delivered = %v; want %v", out.delivered, want)
+	}
+	for i := range want {
+		if out.delivered[i] != want[i] {
+			t.Errorf("TestDeliverReorg delivered[%d] = %s; want %s", i, out.delivered[i], want[i])
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package params
 
 import (
+	"github.com/iquidus/blockspider/admin"
 	"github.com/iquidus/blockspider/common"
 	"github.com/iquidus/blockspider/crawler"
 	"github.com/iquidus/blockspider/kafka"
+	"github.com/iquidus/blockspider/nats"
 	"github.com/iquidus/blockspider/state"
+	"github.com/iquidus/blockspider/storage"
 )
 
 type TransmuteConfig struct {
@@ -13,11 +16,25 @@ type TransmuteConfig struct {
 	Alchemy        common.AlchemyConfig `json:"alchemy"`
 }
 
+// MetricsConfig is the metrics section of configs from before the admin api,
+// its addr is used as admin.addr
+type MetricsConfig struct {
+	Addr string `json:"addr"` // deprecated, use admin.addr
+}
+
+// DefaultShutdownTimeout is used when Config.ShutdownTimeout is not set
+const DefaultShutdownTimeout = "30s"
+
 type Config struct {
-	ChainId   uint64           `json:"chainId"`
-	Crawler   crawler.Config   `json:"crawler"`
-	Rpc       common.RPCConfig `json:"rpc"`
-	State     state.Config     `json:"state"`
-	Kafka     kafka.Config     `json:"kafka"`
-	Transmute TransmuteConfig  `json:"transmute"`
+	ChainId         uint64           `json:"chainId"`
+	Crawler         crawler.Config   `json:"crawler"`
+	Rpc             common.RPCConfig `json:"rpc"`
+	State           state.Config     `json:"state"`
+	Kafka           kafka.Config     `json:"kafka"`
+	Nats            nats.Config      `json:"nats"`
+	Storage         storage.Config   `json:"storage"`
+	Transmute       TransmuteConfig  `json:"transmute"`
+	Admin           admin.Config     `json:"admin"`
+	Metrics         MetricsConfig    `json:"metrics"`
+	ShutdownTimeout string           `json:"shutdownTimeout"`
 }
@@ -0,0 +1,19 @@
+package sink
+
+import "context"
+
+type seqKey struct{}
+
+// WithSeq returns a context carrying the outbox sequence of the message being
+// written. Sinks add it to de-duplication ids, so a redelivered message keeps
+// its id while a block accepted again after a reorg gets a new one.
+func WithSeq(ctx context.Context, seq uint64) context.Context {
+	return context.WithValue(ctx, seqKey{}, seq)
+}
+
+// Seq returns the outbox sequence set by WithSeq, or 0 for messages written
+// without the outbox (e.g: by backfill)
+func Seq(ctx context.Context) uint64 {
+	seq, _ := ctx.Value(seqKey{}).(uint64)
+	return seq
+}
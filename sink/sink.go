@@ -0,0 +1,96 @@
+package sink
+
+import (
+	"context"
+	"errors"
+
+	"github.com/iquidus/blockspider/common"
+)
+
+// Sink receives blocks as they are accepted into, or dropped from, the
+// canonical chain. Implementations must be safe to call from the crawler's
+// sync routine.
+type Sink interface {
+	// Accept is called for each new block added to the canonical chain
+	Accept(ctx context.Context, block *common.Block) error
+	// Drop is called for each block removed from the canonical chain by a reorg
+	Drop(ctx context.Context, block *common.Block) error
+	// Confirm is called for each block once it is past the confirmation depth
+	Confirm(ctx context.Context, block *common.Block) error
+	// Finalize is called for each block once the node reports it as finalized
+	Finalize(ctx context.Context, block *common.Block) error
+	// Reorg is called once per reorg, after the dropped and accepted blocks
+	Reorg(ctx context.Context, reorg *common.Reorg) error
+	// Flush blocks until all previously accepted/dropped blocks are written
+	Flush(ctx context.Context) error
+	// Close releases the sink's resources, it must not be used afterwards
+	Close() error
+}
+
+// Multi fans blocks out to several sinks in order, stopping at the first error
+type Multi []Sink
+
+func (m Multi) Accept(ctx context.Context, block *common.Block) error {
+	for _, s := range m {
+		if err := s.Accept(ctx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Multi) Drop(ctx context.Context, block *common.Block) error {
+	for _, s := range m {
+		if err := s.Drop(ctx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Multi) Confirm(ctx context.Context, block *common.Block) error {
+	for _, s := range m {
+		if err := s.Confirm(ctx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Multi) Finalize(ctx context.Context, block *common.Block) error {
+	for _, s := range m {
+		if err := s.Finalize(ctx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Multi) Reorg(ctx context.Context, reorg *common.Reorg) error {
+	for _, s := range m {
+		if err := s.Reorg(ctx, reorg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Multi) Flush(ctx context.Context) error {
+	for _, s := range m {
+		if err := s.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every sink, returning all errors
+func (m Multi) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
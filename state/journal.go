@@ -0,0 +1,89 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/iquidus/blockspider/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// default number of reorgs kept in the journal
+const DefaultJournalLimit = 1000
+
+// reorg journal, keyed by sequence
+var reorgsBucket = []byte("reorgs")
+
+// StageReorg queues a reorg message for the outbox and a journal entry,
+// both written by the next Save along with the reorged cache
+func (s *State) StageReorg(status string, reorg common.Reorg) {
+	lock.Lock()
+	defer lock.Unlock()
+	s.staged = append(s.staged, Message{Status: status, Reorg: &reorg})
+	s.reorgs = append(s.reorgs, reorg)
+}
+
+// Reorgs returns up to limit reorgs from the journal, newest first
+func (s *State) Reorgs(limit int) ([]common.Reorg, error) {
+	reorgs := []common.Reorg{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(reorgsBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(reorgs) < limit; k, v = c.Prev() {
+			var r common.Reorg
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			reorgs = append(reorgs, r)
+		}
+		return nil
+	})
+	return reorgs, err
+}
+
+// writes staged reorgs to the journal, removing the oldest entries past the
+// limit. Must be called within save.
+func (s *State) writeReorgs(tx *bolt.Tx) error {
+	if len(s.reorgs) == 0 {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists(reorgsBucket)
+	if err != nil {
+		return err
+	}
+	for _, r := range s.reorgs {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err = b.Put(key, v); err != nil {
+			return err
+		}
+	}
+
+	limit := s.Config.JournalLimit
+	if limit <= 0 {
+		limit = DefaultJournalLimit
+	}
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	for k, _ := c.First(); k != nil && n > limit; k, _ = c.First() {
+		if err = c.Delete(); err != nil {
+			return err
+		}
+		n--
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/disk"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	legacySuffix    = ".legacy.json" // appended to a json state file once migrated
+	migratingSuffix = ".migrating"   // db being created from a json state file
+)
+
+// StateFile is the json state file format used before the bolt db
+type StateFile struct {
+	ChainId   *uint64        `json:"chainId"`
+	Timestamp int64          `json:"updated"`
+	Cache     []common.Block `json:"cache"`
+}
+
+// migrateLegacyFile replaces a json state file at path with a db containing
+// the same chain id and cached blocks. The json file is kept with legacySuffix.
+// Returns true if a migration took place.
+func migrateLegacyFile(path string) (bool, error) {
+	tmp := path + migratingSuffix
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		// finish a migration interrupted after the json file was moved
+		if _, err := os.Stat(tmp); err == nil {
+			return true, os.Rename(tmp, path)
+		}
+		return false, nil
+	}
+	var sf StateFile
+	if err := disk.ReadJsonFile[StateFile](path, &sf); err != nil {
+		// not json, assume it's already a db
+		return false, nil
+	}
+
+	// build the db alongside the json file, then swap them
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	db, err := bolt.Open(tmp, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return false, err
+	}
+	err = importStateFile(db, &sf)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = os.Rename(path, path+legacySuffix); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// writes the chain id and cached blocks from a json state file to db
+func importStateFile(db *bolt.DB, sf *StateFile) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		blocks, err := tx.CreateBucketIfNotExists(blocksBucket)
+		if err != nil {
+			return err
+		}
+		if sf.ChainId != nil {
+			if err = putUint64(meta, chainIdKey, *sf.ChainId); err != nil {
+				return err
+			}
+		}
+		for i := range sf.Cache {
+			v, err := json.Marshal(sf.Cache[i])
+			if err != nil {
+				return err
+			}
+			if err = blocks.Put(blockKey(&sf.Cache[i]), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
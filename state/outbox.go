@@ -0,0 +1,92 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/iquidus/blockspider/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// outgoing messages, keyed by sequence
+var outboxBucket = []byte("outbox")
+
+// Message is an outgoing block or reorg message recorded in the outbox
+type Message struct {
+	Seq    uint64        `json:"-"`
+	Status string        `json:"status"`
+	Block  common.Block  `json:"block"`
+	Reorg  *common.Reorg `json:"reorg,omitempty"` // set for reorg messages only
+}
+
+// Stage queues a message to be written to the outbox by the next Save, in
+// the same transaction as the cache (cursor) changes
+func (s *State) Stage(status string, block common.Block) {
+	lock.Lock()
+	defer lock.Unlock()
+	s.staged = append(s.staged, Message{Status: status, Block: block})
+}
+
+// Pending returns up to limit messages from the outbox, oldest first
+func (s *State) Pending(limit int) ([]Message, error) {
+	var messages []Message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && len(messages) < limit; k, v = c.Next() {
+			var m Message
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			m.Seq = binary.BigEndian.Uint64(k)
+			messages = append(messages, m)
+		}
+		return nil
+	})
+	return messages, err
+}
+
+// Ack removes delivered messages from the outbox
+func (s *State) Ack(seqs ...uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return nil
+		}
+		key := make([]byte, 8)
+		for _, seq := range seqs {
+			binary.BigEndian.PutUint64(key, seq)
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writes staged messages to the outbox, must be called within save
+func (s *State) writeStaged(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(outboxBucket)
+	if err != nil {
+		return err
+	}
+	for _, m := range s.staged {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err = b.Put(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
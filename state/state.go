@@ -1,19 +1,42 @@
 package state
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/iquidus/blockspider/cache"
 	"github.com/iquidus/blockspider/common"
-	"github.com/iquidus/blockspider/disk"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bolt buckets
+var (
+	metaBucket   = []byte("meta")   // chain id and cursor metadata
+	blocksBucket = []byte("blocks") // cached chain segment, keyed by number + hash
+)
+
+// meta keys
+var (
+	chainIdKey   = []byte("chainId")
+	cursorKey    = []byte("cursor")
+	confirmedKey = []byte("confirmed")
+	finalizedKey = []byte("finalized")
 )
 
 type State struct {
-	Syncing bool    `json:"syncing"`
-	Config  *Config `json:"config"`
-	Cache   *cache.BlockStack[common.Block]
+	Syncing   bool    `json:"syncing"`
+	Config    *Config `json:"config"`
+	Cache     *cache.BlockStack[common.Block]
+	Confirmed uint64 // highest block CONFIRMED has been staged for
+	Finalized uint64 // highest block FINALIZED has been staged for
+	db        *bolt.DB
+	staged    []Message      // messages to write to the outbox on save
+	reorgs    []common.Reorg // reorgs to write to the journal on save
 }
 
 type StateData struct {
@@ -21,14 +44,16 @@ type StateData struct {
 }
 
 type Config struct {
-	Path       string `json:"path"`
-	CacheLimit int    `json:"cache"`
+	Path         string `json:"path"`
+	CacheLimit   int    `json:"cache"`
+	JournalLimit int    `json:"journal"` // max reorgs kept in the journal (0 = DefaultJournalLimit)
 }
 
-type StateFile struct {
-	ChainId   *uint64        `json:"chainId"`
-	Timestamp int64          `json:"updated"`
-	Cache     []common.Block `json:"cache"`
+// Cursor records the cached head as of the last save
+type Cursor struct {
+	Number    uint64 `json:"number"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"updated"`
 }
 
 var state *StateData = nil
@@ -41,17 +66,34 @@ func Init(cfg *Config, chainId *uint64) (*State, error) {
 		Config:  cfg,
 		Cache:   cache.New[common.Block](&cfg.CacheLimit),
 	}
-	err := s.load()
+	// replace a json state file with a db before opening it
+	_, err := migrateLegacyFile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	s.db, err = bolt.Open(cfg.Path, 0644, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
-		// set singleton
+		return nil, err
+	}
+	err = s.load()
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	if state.ChainId == nil {
+		// new state, set singleton
 		state = &StateData{
 			ChainId: chainId,
 		}
-		// write to disc
+		// write to disk
 		err = s.save()
 		if err != nil {
+			s.db.Close()
 			return nil, err
 		}
+	} else if chainId != nil && *state.ChainId != *chainId {
+		s.db.Close()
+		return nil, fmt.Errorf("chain id mismatch: state has %d, config has %d", *state.ChainId, *chainId)
 	}
 	return s, nil
 }
@@ -60,37 +102,155 @@ func (s *State) Save() error {
 	return s.save()
 }
 
+func (s *State) Close() error {
+	return s.db.Close()
+}
+
+// Cursor returns the cursor as of the last save
+func (s *State) Cursor() (Cursor, error) {
+	var c Cursor
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket)
+		if b == nil {
+			return errors.New("cursor not found")
+		}
+		v := b.Get(cursorKey)
+		if v == nil {
+			return errors.New("cursor not found")
+		}
+		return json.Unmarshal(v, &c)
+	})
+	return c, err
+}
+
+// blockKey returns the db key for a block, big endian number followed by hash
+// so keys iterate in chain order
+func blockKey(b *common.Block) []byte {
+	key := make([]byte, 8, 8+len(b.Hash))
+	binary.BigEndian.PutUint64(key, b.Number)
+	return append(key, b.Hash...)
+}
+
+func putUint64(b *bolt.Bucket, key []byte, n uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return b.Put(key, v)
+}
+
 func (s *State) load() error {
 	lock.Lock()
 	defer lock.Unlock()
-	var sf StateFile
-	err := disk.ReadJsonFile[StateFile](s.Config.Path, &sf)
-	if err != nil {
-		return err
-	}
-	state = &StateData{
-		ChainId: sf.ChainId,
-	}
-	if sf.Cache == nil {
-		return errors.New("cache is nil")
-	}
-	for i := len(sf.Cache) - 1; i >= 0; i-- {
-		s.Cache.Push(sf.Cache[i])
-	}
-	return nil
+	state = &StateData{}
+	return s.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			if v := meta.Get(chainIdKey); v != nil {
+				chainId := binary.BigEndian.Uint64(v)
+				state.ChainId = &chainId
+			}
+			if v := meta.Get(confirmedKey); v != nil {
+				s.Confirmed = binary.BigEndian.Uint64(v)
+			}
+			if v := meta.Get(finalizedKey); v != nil {
+				s.Finalized = binary.BigEndian.Uint64(v)
+			}
+		}
+		blocks := tx.Bucket(blocksBucket)
+		if blocks == nil {
+			return nil
+		}
+		// keys are ordered oldest first
+		return blocks.ForEach(func(k, v []byte) error {
+			var block common.Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return err
+			}
+			s.Cache.Push(block)
+			return nil
+		})
+	})
 }
 
+// save writes changes to the cached chain segment, the cursor and any staged
+// outbox messages in a single transaction. Only blocks added to or removed
+// from the cache are written.
 func (s *State) save() error {
 	lock.Lock()
 	defer lock.Unlock()
-	var sf = StateFile{
-		ChainId:   state.ChainId,
-		Timestamp: time.Now().Unix(),
-		Cache:     s.Cache.Items(),
-	}
-	err := disk.WriteJsonFile[StateFile](sf, s.Config.Path, 0644)
-	if err != nil {
-		return err
+	items := s.Cache.Items()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.writeStaged(tx); err != nil {
+			return err
+		}
+		if err := s.writeReorgs(tx); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		blocks, err := tx.CreateBucketIfNotExists(blocksBucket)
+		if err != nil {
+			return err
+		}
+
+		keep := make(map[string]int, len(items))
+		for i := range items {
+			keep[string(blockKey(&items[i]))] = i
+		}
+		// remove blocks no longer in cache
+		var stale [][]byte
+		err = blocks.ForEach(func(k, v []byte) error {
+			if _, ok := keep[string(k)]; ok {
+				delete(keep, string(k))
+			} else {
+				stale = append(stale, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err = blocks.Delete(k); err != nil {
+				return err
+			}
+		}
+		// add blocks new to cache
+		for k, i := range keep {
+			v, err := json.Marshal(items[i])
+			if err != nil {
+				return err
+			}
+			if err = blocks.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		if state.ChainId != nil {
+			if err = putUint64(meta, chainIdKey, *state.ChainId); err != nil {
+				return err
+			}
+		}
+		if err = putUint64(meta, confirmedKey, s.Confirmed); err != nil {
+			return err
+		}
+		if err = putUint64(meta, finalizedKey, s.Finalized); err != nil {
+			return err
+		}
+		cursor := Cursor{Timestamp: time.Now().Unix()}
+		if len(items) > 0 {
+			cursor.Number = items[0].Number
+			cursor.Hash = items[0].Hash
+		}
+		v, err := json.Marshal(cursor)
+		if err != nil {
+			return err
+		}
+		return meta.Put(cursorKey, v)
+	})
+	if err == nil {
+		s.staged = nil
+		s.reorgs = nil
 	}
-	return nil
+	return err
 }
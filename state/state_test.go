@@ -0,0 +1,216 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/disk"
+	bolt "go.etcd.io/bbolt"
+)
+
+var testChainId uint64 = 8
+
+func testBlock(number uint64, hash string) common.Block {
+	return common.Block{Number: number, Hash: hash}
+}
+
+func openState(t *testing.T, path string) *State {
+	s, err := Init(&Config{Path: path, CacheLimit: 4}, &testChainId)
+	if err != nil {
+		t.Fatal("Error initializing state: ", err)
+	}
+	return s
+}
+
+// returns the hashes stored in the db, oldest first
+func storedHashes(t *testing.T, s *State) []string {
+	var hashes []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).ForEach(func(k, v []byte) error {
+			hashes = append(hashes, string(k[8:]))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal("Error reading blocks: ", err)
+	}
+	return hashes
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s := openState(t, path)
+	for i := uint64(1); i <= 6; i++ {
+		s.Cache.Push(testBlock(i, string(rune('a'+i-1))))
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	// only the last 4 blocks are kept
+	got := storedHashes(t, s)
+	want := []string{"c", "d", "e", "f"}
+	if len(got) != len(want) {
+		t.Fatalf("TestSaveLoad stored = %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("TestSaveLoad stored[%d] = %s; want %s", i, got[i], want[i])
+		}
+	}
+
+	// replace the head as a reorg would
+	s.Cache.Pop()
+	s.Cache.Push(testBlock(6, "g"))
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	cursor, err := s.Cursor()
+	if err != nil {
+		t.Fatal("Error getting cursor: ", err)
+	}
+	if cursor.Number != 6 || cursor.Hash != "g" {
+		t.Errorf("TestSaveLoad cursor = %d %s; want 6 g", cursor.Number, cursor.Hash)
+	}
+	s.Confirmed, s.Finalized = 4, 3
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	s.Close()
+
+	// reopen
+	s = openState(t, path)
+	defer s.Close()
+	if s.Cache.Count() != 4 {
+		t.Errorf("TestSaveLoad count = %d; want 4", s.Cache.Count())
+	}
+	head, _ := s.Cache.Peak()
+	if head.Hash != "g" {
+		t.Errorf("TestSaveLoad head = %s; want g", head.Hash)
+	}
+	if got := storedHashes(t, s); len(got) != 4 || got[3] != "g" {
+		t.Errorf("TestSaveLoad stored = %v", got)
+	}
+	if s.Confirmed != 4 || s.Finalized != 3 {
+		t.Errorf("TestSaveLoad confirmed, finalized = %d, %d; want 4, 3", s.Confirmed, s.Finalized)
+	}
+}
+
+func TestChainIdMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s := openState(t, path)
+	s.Close()
+
+	other := testChainId + 1
+	_, err := Init(&Config{Path: path, CacheLimit: 4}, &other)
+	if err == nil {
+		t.Error("TestChainIdMismatch err = nil; want error")
+	}
+}
+
+func TestReorgJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := Init(&Config{Path: path, CacheLimit: 4, JournalLimit: 2}, &testChainId)
+	if err != nil {
+		t.Fatal("Error initializing state: ", err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		s.StageReorg("REORG", common.Reorg{Ancestor: common.BlockRef{Number: i}, Depth: int(i)})
+		// nothing is journaled until saved
+		if reorgs, _ := s.Reorgs(10); len(reorgs) != int(i-1) {
+			t.Fatalf("TestReorgJournal unsaved = %d; want %d", len(reorgs), i-1)
+		}
+		if err = s.Save(); err != nil {
+			t.Fatal("Error saving state: ", err)
+		}
+	}
+	s.Close()
+
+	// the oldest reorg is pruned, and the journal survives a restart
+	s = openState(t, path)
+	defer s.Close()
+	reorgs, err := s.Reorgs(10)
+	if err != nil {
+		t.Fatal("Error reading journal: ", err)
+	}
+	if len(reorgs) != 2 || reorgs[0].Ancestor.Number != 3 || reorgs[1].Ancestor.Number != 2 {
+		t.Errorf("TestReorgJournal = %+v; want 3, 2", reorgs)
+	}
+	if reorgs, _ = s.Reorgs(1); len(reorgs) != 1 || reorgs[0].Depth != 3 {
+		t.Errorf("TestReorgJournal limit = %+v; want newest only", reorgs)
+	}
+	// the reorgs were also staged for the outbox
+	messages, err := s.Pending(10)
+	if err != nil {
+		t.Fatal("Error reading outbox: ", err)
+	}
+	if len(messages) != 3 || messages[0].Reorg == nil || messages[0].Reorg.Depth != 1 {
+		t.Errorf("TestReorgJournal outbox = %+v; want 3 reorgs", messages)
+	}
+}
+
+func TestMigrateLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	sf := StateFile{
+		ChainId: &testChainId,
+		Cache:   []common.Block{testBlock(3, "c"), testBlock(2, "b"), testBlock(1, "a")},
+	}
+	if err := disk.WriteJsonFile[StateFile](sf, path, 0644); err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+
+	s := openState(t, path)
+	defer s.Close()
+	if s.Cache.Count() != 3 {
+		t.Errorf("TestMigrateLegacyFile count = %d; want 3", s.Cache.Count())
+	}
+	head, _ := s.Cache.Peak()
+	if head.Hash != "c" {
+		t.Errorf("TestMigrateLegacyFile head = %s; want c", head.Hash)
+	}
+	if _, err := os.Stat(path + legacySuffix); err != nil {
+		t.Errorf("TestMigrateLegacyFile legacy file: %v", err)
+	}
+}
+
+func TestMigrateSkipsDb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := openState(t, path)
+	s.Cache.Push(testBlock(1, "a"))
+	if err := s.Save(); err != nil {
+		t.Fatal("Error saving state: ", err)
+	}
+	s.Close()
+	// a stale json file alongside the db is never migrated over it
+	sf := StateFile{ChainId: &testChainId, Cache: []common.Block{testBlock(9, "z")}}
+	if err := disk.WriteJsonFile[StateFile](sf, path+".bak", 0644); err != nil {
+		t.Fatal("Error writing file: ", err)
+	}
+
+	s = openState(t, path)
+	defer s.Close()
+	if head, _ := s.Cache.Peak(); s.Cache.Count() != 1 || head.Hash != "a" {
+		t.Errorf("TestMigrateSkipsDb head = %s, count %d; want a, 1", head.Hash, s.Cache.Count())
+	}
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	// db was built but not yet moved into place
+	db, err := bolt.Open(path+migratingSuffix, 0644, nil)
+	if err != nil {
+		t.Fatal("Error opening db: ", err)
+	}
+	err = importStateFile(db, &StateFile{ChainId: &testChainId, Cache: []common.Block{testBlock(1, "a")}})
+	if err != nil {
+		t.Fatal("Error importing state: ", err)
+	}
+	db.Close()
+
+	s := openState(t, path)
+	defer s.Close()
+	if s.Cache.Count() != 1 {
+		t.Errorf("TestMigrateInterrupted count = %d; want 1", s.Cache.Count())
+	}
+}
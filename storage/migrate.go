@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is a versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+}
+
+// loads migrations for the given driver from the embedded migrations dir.
+// Files are named <version>_<name>.sql, e.g: 0001_init.sql
+func loadMigrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		version, desc, found := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		if !found {
+			return nil, fmt.Errorf("invalid migration name: %s", name)
+		}
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %s", name)
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{v, desc, string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// migrate applies any migrations newer than the current schema version,
+// each in its own transaction. Returns the number of migrations applied.
+func migrate(ctx context.Context, db *sql.DB, migrations []Migration) (int, error) {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		name        TEXT NOT NULL,
+		applied_at  BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, err
+		}
+		if _, err = tx.ExecContext(ctx, m.Sql); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+			m.Version, m.Name, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err = tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
@@ -0,0 +1,21 @@
+package storage
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		t.Fatal("Error loading migrations: ", err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("TestLoadMigrations version = %d; want %d", m.Version, i+1)
+		}
+		if m.Sql == "" {
+			t.Errorf("TestLoadMigrations %d sql is empty", m.Version)
+		}
+	}
+	if _, err = loadMigrations("unknown"); err == nil {
+		t.Error("TestLoadMigrations unknown driver err = nil; want error")
+	}
+}
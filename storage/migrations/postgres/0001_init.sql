@@ -0,0 +1,67 @@
+CREATE TABLE blocks (
+	hash               TEXT PRIMARY KEY,
+	number             BIGINT NOT NULL,
+	parent_hash        TEXT NOT NULL,
+	timestamp          BIGINT NOT NULL,
+	base_fee_per_gas   NUMERIC NOT NULL,
+	gas_used           BIGINT NOT NULL,
+	gas_limit          BIGINT NOT NULL,
+	mix_hash           TEXT NOT NULL,
+	state_root         TEXT NOT NULL,
+	total_difficulty   TEXT NOT NULL,
+	sha3_uncles        TEXT NOT NULL,
+	miner              TEXT NOT NULL,
+	difficulty         TEXT NOT NULL,
+	nonce              TEXT NOT NULL,
+	transaction_count  BIGINT NOT NULL,
+	transactions_root  TEXT NOT NULL,
+	receipts_root      TEXT NOT NULL,
+	logs_bloom         TEXT NOT NULL,
+	extra_data         TEXT NOT NULL,
+	uncles             JSONB NOT NULL,
+	removed            BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX blocks_number_idx ON blocks (number);
+
+CREATE TABLE transactions (
+	block_hash                TEXT NOT NULL REFERENCES blocks (hash) ON DELETE CASCADE,
+	block_number              BIGINT NOT NULL,
+	hash                      TEXT NOT NULL,
+	transaction_index         BIGINT NOT NULL,
+	from_address              TEXT NOT NULL,
+	to_address                TEXT NOT NULL,
+	value                     NUMERIC NOT NULL,
+	gas                       BIGINT NOT NULL,
+	gas_price                 BIGINT NOT NULL,
+	max_fee_per_gas           BIGINT NOT NULL,
+	max_priority_fee_per_gas  BIGINT NOT NULL,
+	nonce                     BIGINT NOT NULL,
+	status                    BIGINT NOT NULL,
+	gas_used                  BIGINT NOT NULL,
+	cumulative_gas_used       BIGINT NOT NULL,
+	effective_gas_price       BIGINT NOT NULL,
+	created_contract          TEXT NOT NULL,
+	removed                   BOOLEAN NOT NULL DEFAULT FALSE,
+	PRIMARY KEY (block_hash, hash)
+);
+
+CREATE INDEX transactions_hash_idx ON transactions (hash);
+CREATE INDEX transactions_from_idx ON transactions (from_address);
+CREATE INDEX transactions_to_idx ON transactions (to_address);
+
+CREATE TABLE logs (
+	block_hash         TEXT NOT NULL REFERENCES blocks (hash) ON DELETE CASCADE,
+	block_number       BIGINT NOT NULL,
+	log_index          BIGINT NOT NULL,
+	transaction_hash   TEXT NOT NULL,
+	transaction_index  BIGINT NOT NULL,
+	address            TEXT NOT NULL,
+	topics             JSONB NOT NULL,
+	data               TEXT NOT NULL,
+	removed            BOOLEAN NOT NULL DEFAULT FALSE,
+	PRIMARY KEY (block_hash, log_index)
+);
+
+CREATE INDEX logs_address_idx ON logs (address);
+CREATE INDEX logs_transaction_hash_idx ON logs (transaction_hash);
@@ -0,0 +1,2 @@
+ALTER TABLE blocks ADD COLUMN confirmed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE blocks ADD COLUMN finalized BOOLEAN NOT NULL DEFAULT FALSE;
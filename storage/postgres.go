@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// NewPostgres connects to the postgres database at cfg.Dsn and applies any
+// pending schema migrations
+func NewPostgres(cfg *Config) (*Store, error) {
+	db, err := sql.Open("pgx", cfg.Dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err = migrate(ctx, db, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, markRemoved: cfg.MarkRemoved}, nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+// postgresDsnEnv names the variable holding the dsn of a postgres server to
+// run the store tests against, in key=value form without a dbname, e.g:
+// "host=localhost user=postgres password=postgres sslmode=disable". If it
+// isn't set an embedded server is started instead.
+const postgresDsnEnv = "POSTGRES_TEST_DSN"
+
+var (
+	// dsn of the postgres server, empty if none is available
+	pgDsn string
+	// reason the embedded server isn't available
+	pgErr error
+)
+
+func freePort() (uint32, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return uint32(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := func() int {
+		if pgDsn = os.Getenv(postgresDsnEnv); pgDsn != "" || testing.Short() {
+			return m.Run()
+		}
+		dir, err := os.MkdirTemp("", "blockspider-pg")
+		if err != nil {
+			pgErr = err
+			return m.Run()
+		}
+		defer os.RemoveAll(dir)
+		port, err := freePort()
+		if err != nil {
+			pgErr = err
+			return m.Run()
+		}
+		pg := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Port(port).
+			RuntimePath(dir + "/runtime").
+			DataPath(dir + "/data").
+			Logger(io.Discard))
+		// the binaries are downloaded on first use, and postgres won't run
+		// as root
+		if pgErr = pg.Start(); pgErr == nil {
+			defer pg.Stop()
+			pgDsn = fmt.Sprintf("host=localhost port=%d user=postgres password=postgres sslmode=disable", port)
+		}
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+// creates a fresh database for the test and returns a store connected to it
+func newTestPostgres(t *testing.T, markRemoved bool) *Store {
+	if pgDsn == "" {
+		if testing.Short() {
+			t.Skip("postgres skipped in short mode, set " + postgresDsnEnv + " to run it")
+		}
+		t.Fatal("Error starting embedded postgres, set "+postgresDsnEnv+" or run with -short to skip: ", pgErr)
+	}
+	admin, err := sql.Open("pgx", pgDsn+" dbname=postgres")
+	if err != nil {
+		t.Fatal("Error connecting to postgres: ", err)
+	}
+	defer admin.Close()
+	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "_"))
+	if _, err = admin.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+		t.Fatal("Error dropping database: ", err)
+	}
+	if _, err = admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatal("Error creating database: ", err)
+	}
+
+	s, err := NewPostgres(&Config{Driver: "postgres", Dsn: pgDsn + " dbname=" + name, MarkRemoved: markRemoved})
+	if err != nil {
+		t.Fatal("Error creating store: ", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
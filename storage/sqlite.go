@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	_ "modernc.org/sqlite"
+)
+
+// sqlite connection pragmas, foreign keys are required for cascading deletes
+var sqlitePragmas = []string{
+	"foreign_keys(1)",
+	"journal_mode(WAL)",
+	"busy_timeout(5000)",
+}
+
+// NewSQLite opens (or creates) the sqlite database file at cfg.Dsn and
+// applies any pending schema migrations
+func NewSQLite(cfg *Config) (*Store, error) {
+	path, err := homedir.Expand(cfg.Dsn)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"_pragma": sqlitePragmas}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only supports a single writer
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err = migrate(ctx, db, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, markRemoved: cfg.MarkRemoved}, nil
+}
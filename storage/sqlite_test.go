@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLite(t *testing.T, markRemoved bool) *Store {
+	dsn := filepath.Join(t.TempDir(), "blockspider.db")
+	s, err := NewSQLite(&Config{Driver: "sqlite", Dsn: dsn, MarkRemoved: markRemoved})
+	if err != nil {
+		t.Fatal("Error creating store: ", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/sink"
+)
+
+var _ sink.Sink = (*Store)(nil)
+
+// Store materialises accepted blocks, their transactions and logs in a sql database
+type Store struct {
+	db          *sql.DB
+	markRemoved bool
+}
+
+const insertBlock = `INSERT INTO blocks (
+	hash, number, parent_hash, timestamp, base_fee_per_gas, gas_used, gas_limit,
+	mix_hash, state_root, total_difficulty, sha3_uncles, miner, difficulty, nonce,
+	transaction_count, transactions_root, receipts_root, logs_bloom, extra_data, uncles
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)`
+
+const insertTransaction = `INSERT INTO transactions (
+	block_hash, block_number, hash, transaction_index, from_address, to_address, value,
+	gas, gas_price, max_fee_per_gas, max_priority_fee_per_gas, nonce, status, gas_used,
+	cumulative_gas_used, effective_gas_price, created_contract
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
+
+const insertLog = `INSERT INTO logs (
+	block_hash, block_number, log_index, transaction_hash, transaction_index, address, topics, data
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+const selectHead = `SELECT hash, number, parent_hash, timestamp
+FROM blocks WHERE removed = FALSE ORDER BY number DESC LIMIT 1`
+
+// Accept writes block, its transactions and logs in a single transaction.
+// Any previous copy of the block (e.g: one marked removed) is replaced.
+func (s *Store) Accept(ctx context.Context, block *common.Block) error {
+	uncles, err := json.Marshal(nonNil(block.Uncles))
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM blocks WHERE hash = $1", block.Hash); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, insertBlock,
+		block.Hash, block.Number, block.ParentHash, block.Timestamp, numeric(block.BaseFeePerGas),
+		block.GasUsed, block.GasLimit, block.MixHash, block.StateRoot, block.TotalDifficulty,
+		block.Sha3Uncles, block.Miner, block.Difficulty, block.Nonce, block.TransactionCount,
+		block.TransactionsRoot, block.ReceiptsRoot, block.LogsBloom, block.ExtraData, string(uncles))
+	if err != nil {
+		return err
+	}
+
+	if len(block.Transactions) > 0 {
+		stmt, err := tx.PrepareContext(ctx, insertTransaction)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, t := range block.Transactions {
+			_, err = stmt.ExecContext(ctx,
+				block.Hash, block.Number, t.Hash, t.Index, t.From, t.To, numeric(t.Value),
+				t.Gas, t.GasPrice, t.MaxFeePerGas, t.MaxPriorityFeePerGas, t.Nonce, t.Status, t.GasUsed,
+				t.CumulativeGasUsed, t.EffectiveGasPrice, t.CreatedContract)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(block.Logs) > 0 {
+		stmt, err := tx.PrepareContext(ctx, insertLog)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, l := range block.Logs {
+			topics, err := json.Marshal(nonNil(l.Topics))
+			if err != nil {
+				return err
+			}
+			_, err = stmt.ExecContext(ctx,
+				block.Hash, block.Number, l.Index, l.Transaction.Hash, l.Transaction.Index,
+				l.Address, string(topics), l.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Drop deletes block, its transactions and logs, or marks them as removed
+func (s *Store) Drop(ctx context.Context, block *common.Block) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.markRemoved {
+		for _, q := range []string{
+			"UPDATE blocks SET removed = TRUE WHERE hash = $1",
+			"UPDATE transactions SET removed = TRUE WHERE block_hash = $1",
+			"UPDATE logs SET removed = TRUE WHERE block_hash = $1",
+		} {
+			if _, err = tx.ExecContext(ctx, q, block.Hash); err != nil {
+				return err
+			}
+		}
+	} else {
+		// transactions and logs cascade
+		if _, err = tx.ExecContext(ctx, "DELETE FROM blocks WHERE hash = $1", block.Hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Confirm marks block as past the confirmation depth
+func (s *Store) Confirm(ctx context.Context, block *common.Block) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE blocks SET confirmed = TRUE WHERE hash = $1", block.Hash)
+	return err
+}
+
+// Finalize marks block as finalized, finalized blocks are also confirmed
+func (s *Store) Finalize(ctx context.Context, block *common.Block) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE blocks SET confirmed = TRUE, finalized = TRUE WHERE hash = $1", block.Hash)
+	return err
+}
+
+// Reorg is a no-op, the dropped blocks are already removed and reorgs are
+// journaled in state
+func (s *Store) Reorg(ctx context.Context, reorg *common.Reorg) error {
+	return nil
+}
+
+// Flush is a no-op, blocks are committed as they are accepted/dropped
+func (s *Store) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Head returns the highest stored block that has not been removed.
+// Only header fields used to resume crawling are populated, it is a cursor
+// to fetch the full block from the node with.
+func (s *Store) Head(ctx context.Context) (*common.Block, error) {
+	var b common.Block
+	err := s.db.QueryRowContext(ctx, selectHead).Scan(&b.Hash, &b.Number, &b.ParentHash, &b.Timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// numeric columns can't be empty strings
+func numeric(value string) string {
+	if value == "" {
+		return "0"
+	}
+	return value
+}
+
+// marshal nil slices as [] rather than null
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
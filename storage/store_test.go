@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/disk"
+)
+
+const (
+	blockPath    = "../testdata/eth-block-18721004.json"
+	receiptsPath = "../testdata/eth-txn-receipts-18721004.json"
+	testTxns     = 273
+	testLogs     = 383
+)
+
+func loadTestBlock(t *testing.T) common.Block {
+	var rawBlock common.RawBlock
+	if err := disk.ReadJsonFile[common.RawBlock](blockPath, &rawBlock); err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	var receipts []common.RawTransactionReceipt
+	if err := disk.ReadJsonFile[[]common.RawTransactionReceipt](receiptsPath, &receipts); err != nil {
+		t.Fatal("Error reading file: ", err)
+	}
+	block, err := rawBlock.Convert(nil, &receipts)
+	if err != nil {
+		t.Fatal("Error converting block: ", err)
+	}
+	return block
+}
+
+func count(t *testing.T, s *Store, query string, args ...interface{}) int {
+	var n int
+	if err := s.db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal("Error counting rows: ", err)
+	}
+	return n
+}
+
+func checkCounts(t *testing.T, s *Store, blocks, txns, logs int) {
+	t.Helper()
+	if got := count(t, s, "SELECT COUNT(*) FROM blocks WHERE removed = FALSE"); got != blocks {
+		t.Errorf("blocks = %d; want %d", got, blocks)
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM transactions WHERE removed = FALSE"); got != txns {
+		t.Errorf("transactions = %d; want %d", got, txns)
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM logs WHERE removed = FALSE"); got != logs {
+		t.Errorf("logs = %d; want %d", got, logs)
+	}
+}
+
+// the shared tests are run against each driver
+var drivers = []struct {
+	name     string
+	newStore func(t *testing.T, markRemoved bool) *Store
+}{
+	{"sqlite", newTestSQLite},
+	{"postgres", newTestPostgres},
+}
+
+func TestStore(t *testing.T) {
+	for _, d := range drivers {
+		d := d
+		t.Run(d.name, func(t *testing.T) {
+			t.Run("AcceptDrop", func(t *testing.T) {
+				testAcceptDrop(t, d.newStore(t, false))
+			})
+			t.Run("MarkRemoved", func(t *testing.T) {
+				testAcceptDrop(t, d.newStore(t, true))
+			})
+			t.Run("Finality", func(t *testing.T) {
+				testFinality(t, d.newStore(t, false))
+			})
+			t.Run("Migrate", func(t *testing.T) {
+				testMigrateIdempotent(t, d.newStore(t, false), d.name)
+			})
+		})
+	}
+}
+
+func testAcceptDrop(t *testing.T, s *Store) {
+	ctx := context.Background()
+	block := loadTestBlock(t)
+
+	if _, err := s.Head(ctx); err != ErrEmpty {
+		t.Errorf("Head err = %v; want %v", err, ErrEmpty)
+	}
+
+	if err := s.Accept(ctx, &block); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	checkCounts(t, s, 1, testTxns, testLogs)
+
+	// accepting again replaces the block
+	if err := s.Accept(ctx, &block); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	checkCounts(t, s, 1, testTxns, testLogs)
+
+	head, err := s.Head(ctx)
+	if err != nil {
+		t.Fatal("Error getting head: ", err)
+	}
+	if head.Hash != block.Hash || head.Number != block.Number || head.ParentHash != block.ParentHash {
+		t.Errorf("Head = %d %s; want %d %s", head.Number, head.Hash, block.Number, block.Hash)
+	}
+
+	// child block becomes the head
+	child := common.Block{Number: block.Number + 1, Hash: "0x01", ParentHash: block.Hash}
+	if err := s.Accept(ctx, &child); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	if head, _ = s.Head(ctx); head.Hash != child.Hash {
+		t.Errorf("Head = %s; want %s", head.Hash, child.Hash)
+	}
+
+	// dropped blocks are no longer the head
+	if err := s.Drop(ctx, &child); err != nil {
+		t.Fatal("Error dropping block: ", err)
+	}
+	if err := s.Drop(ctx, &block); err != nil {
+		t.Fatal("Error dropping block: ", err)
+	}
+	checkCounts(t, s, 0, 0, 0)
+	if _, err := s.Head(ctx); err != ErrEmpty {
+		t.Errorf("Head err = %v; want %v", err, ErrEmpty)
+	}
+
+	// removed rows are kept only when marking
+	want := 0
+	if s.markRemoved {
+		want = testTxns
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM transactions"); got != want {
+		t.Errorf("removed transactions = %d; want %d", got, want)
+	}
+
+	// block can be accepted again after being dropped
+	if err := s.Accept(ctx, &block); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	checkCounts(t, s, 1, testTxns, testLogs)
+}
+
+func testFinality(t *testing.T, s *Store) {
+	ctx := context.Background()
+	block := loadTestBlock(t)
+	if err := s.Accept(ctx, &block); err != nil {
+		t.Fatal("Error accepting block: ", err)
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM blocks WHERE confirmed = TRUE"); got != 0 {
+		t.Errorf("confirmed blocks = %d; want 0", got)
+	}
+
+	if err := s.Confirm(ctx, &block); err != nil {
+		t.Fatal("Error confirming block: ", err)
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM blocks WHERE confirmed = TRUE AND finalized = FALSE"); got != 1 {
+		t.Errorf("confirmed blocks = %d; want 1", got)
+	}
+
+	if err := s.Finalize(ctx, &block); err != nil {
+		t.Fatal("Error finalizing block: ", err)
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM blocks WHERE confirmed = TRUE AND finalized = TRUE"); got != 1 {
+		t.Errorf("finalized blocks = %d; want 1", got)
+	}
+}
+
+func testMigrateIdempotent(t *testing.T, s *Store, driver string) {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		t.Fatal("Error loading migrations: ", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations found")
+	}
+	applied, err := migrate(context.Background(), s.db, migrations)
+	if err != nil {
+		t.Fatal("Error migrating: ", err)
+	}
+	if applied != 0 {
+		t.Errorf("migrate applied = %d; want 0", applied)
+	}
+	if got := count(t, s, "SELECT COUNT(*) FROM schema_migrations"); got != len(migrations) {
+		t.Errorf("schema_migrations = %d; want %d", got, len(migrations))
+	}
+}
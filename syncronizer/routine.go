@@ -15,8 +15,10 @@ func (r *Task) Link() (close bool) {
 	return
 }
 
+// AbortSync marks the task as aborted, the sync stops once the task handler
+// reaches it. Link must still be called.
 func (r *Task) AbortSync() {
-	r.activeSync.abortChan <- r
+	r.abort = true
 }
 
 func (r *Task) stop() {
@@ -1,5 +1,10 @@
 package syncronizer
 
+import (
+	"context"
+	"sync/atomic"
+)
+
 func (s *Synchronizer) startTaskHandler() {
 	// As tasks are created with s.AddLink, and block at task.Link(), this goroutine will
 	// receive them from the channel; it waits until the tasks calls t.Link() (if it didn't already),
@@ -18,7 +23,7 @@ func (s *Synchronizer) startTaskHandler() {
 				abort = s.didAbort(task)
 
 				if abort {
-					s.aborted = true
+					s.aborted.Store(true)
 					task.stop()
 					break loop
 				}
@@ -30,7 +35,7 @@ func (s *Synchronizer) startTaskHandler() {
 				abort = s.didAbort(task)
 
 				if abort {
-					s.aborted = true
+					s.aborted.Store(true)
 					task.closeNext()
 					break loop
 				}
@@ -48,23 +53,24 @@ func (s *Synchronizer) startTaskHandler() {
 				}
 			}
 		}
-		if s.aborted {
+		if s.aborted.Load() {
 			s.flushTasks()
 		}
 	}()
 }
 
 type Synchronizer struct {
-	routines, abortChan   chan *Task
+	ctx                   context.Context
+	routines              chan *Task
 	quitChan, nextChannel chan int
-	aborted               bool
+	aborted               atomic.Bool
 }
 
 // AddLink creates a new task with the function body it's provided, sets up hooks and
-// queues it for execution
+// queues it for execution. Does nothing if the sync was aborted or its context is done
 
 func (s *Synchronizer) AddLink(body func(*Task)) {
-	if s.aborted {
+	if s.aborted.Load() || s.ctx.Err() != nil {
 		return
 	}
 
@@ -107,21 +113,11 @@ func (s *Synchronizer) shouldQuit() bool {
 	}
 }
 
-// Check abortChan if any task sent an abort signal
-// returns true if it is equal to the one that called the method
+// Check if the task aborted. The task sets abort before Link or before
+// returning, both happen before the handler's receive from it.
 
 func (s *Synchronizer) didAbort(t *Task) bool {
-	select {
-	case closedTask := <-s.abortChan:
-		if closedTask == t {
-			return true
-		} else {
-			s.abortChan <- closedTask
-			return false
-		}
-	default:
-		return false
-	}
+	return t.abort
 }
 
 // Sometimes, if there is an abort when len(s.routines) == maxRoutines, and there's a call to
@@ -1,8 +1,11 @@
 package syncronizer
 
 import (
+	"context"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,6 +14,7 @@ import (
 	models "github.com/iquidus/blockspider/common"
 
 	"github.com/iquidus/blockspider/common"
+	"github.com/iquidus/blockspider/fakenode"
 
 	json "github.com/json-iterator/go"
 )
@@ -20,9 +24,14 @@ var rpcClient *common.RPCClient
 func TestMain(m *testing.M) {
 	var c *common.RPCConfig
 
+	// serve the blocks from an in-memory node so the tests run offline
+	node := fakenode.New(&fakenode.Config{})
+	node.Mine(1000)
+	server := httptest.NewServer(node.Handler())
+
 	rpcCfg := []byte(`{
 		"type": "http",
-    	"endpoint": "https://rpc.octano.dev"
+    	"endpoint": "` + server.URL + `"
 	}`)
 
 	err := json.Unmarshal(rpcCfg, &c)
@@ -31,13 +40,20 @@ func TestMain(m *testing.M) {
 		log.Fatal("Error unmarshaling ", "err", err)
 	}
 
-	rpcClient = common.NewRPCClient(c)
+	rpcClient, err = common.NewRPCClient(c)
+	if err != nil {
+		log.Fatal("Error creating rpc client ", "err", err)
+	}
 
-	os.Exit(m.Run())
+	code := m.Run()
+	rpcClient.Close()
+	server.Close()
+	node.Close()
+	os.Exit(code)
 }
 
 func fetchBlock(h uint64) models.RawBlock {
-	block, err := rpcClient.GetBlockByHeight(h)
+	block, err := rpcClient.GetBlockByHeight(context.Background(), h)
 	if err != nil {
 		log.Println("error getting block ", err)
 	}
@@ -167,6 +183,7 @@ func AsyncBlockSyncFunc(maxRoutines, routines int) bool {
 	sync := NewSync(maxRoutines)
 
 	for i := 0; i < routines; i++ {
+		i := i
 		sync.AddLink(func(r *Task) {
 			_ = fetchBlock(uint64(i))
 
@@ -181,6 +198,33 @@ func AsyncBlockSyncFunc(maxRoutines, routines int) bool {
 	return sync.Finish()
 }
 
+func TestSyncContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sync := NewSyncContext(ctx, 5)
+
+	var ran int32
+	for i := 0; i < 100; i++ {
+		if i == 10 {
+			cancel()
+		}
+		sync.AddLink(func(r *Task) {
+			if r.Link() {
+				return
+			}
+			atomic.AddInt32(&ran, 1)
+		})
+	}
+
+	if sync.Finish() {
+		t.Fatalf("TestSyncContext aborted = true; want false")
+	}
+	// tasks queued before cancel are drained, none are added after
+	if ran != 10 {
+		t.Errorf("TestSyncContext ran = %d; want 10", ran)
+	}
+}
+
 func TestSync(t *testing.T) {
 	for k, v := range testTable {
 		t.Run("test_"+strconv.FormatInt(int64(k), 10), func(t *testing.T) {
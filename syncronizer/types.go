@@ -1,6 +1,7 @@
 package syncronizer
 
 import (
+	"context"
 	"os"
 
 	"github.com/ethereum/go-ethereum/log"
@@ -12,17 +13,23 @@ import (
 // the syncronizer know it can quit
 
 func NewSync(maxRoutines int) *Synchronizer {
+	return NewSyncContext(context.Background(), maxRoutines)
+}
+
+// Returns a new sync object bound to ctx. Once ctx is done AddLink stops
+// queuing tasks, tasks already queued still run so Finish drains them
+
+func NewSyncContext(ctx context.Context, maxRoutines int) *Synchronizer {
 	if maxRoutines == 0 {
 		log.Error("Error, cannot start sync with 0 maxroutines, should be atleast 1")
 		os.Exit(1)
 	}
 
-	s := &Synchronizer{}
+	s := &Synchronizer{ctx: ctx}
 
 	s.routines = make(chan *Task, maxRoutines)
 
-	// Buffered channels so sends on these don't block
-	s.abortChan = make(chan *Task, maxRoutines)
+	// Buffered channel so sends on it don't block
 	s.quitChan = make(chan int, 1)
 
 	// Unbuffered so this blocks